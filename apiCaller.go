@@ -2,89 +2,631 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/rpc"
 	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/nilshell/xmlrpc"
 	xsclient "github.com/xenserver/go-xenserver-client"
 )
 
-// ApiCaller hold information about the Xenserver and the credentials
+// ApiCaller hold information about the Xenserver and the credentials.
+// The session is kept between scrapes and renewed when xen invalidates it.
+// Server is the last known pool master, Candidates are tried if it is gone.
+// mutex guards the state and is never held during a request, loginMutex
+// serializes the logins, so a hanging login does not block the getters.
 type ApiCaller struct {
 	Server       string
+	Candidates   []string
+	Scheme       string
 	Username     string
-	Password     string
+	credentials  Credentials
 	xenAPIClient *xsclient.XenAPIClient
+	transport    *certRecorder
+
+	// password is the password of the current login, it is guarded by its
+	// own mutex as the transport redacts it during every request
+	passwordMutex sync.Mutex
+	password      string
+
+	loginMutex sync.Mutex
+
+	mutex           sync.Mutex
+	closed          bool
+	logins          int
+	sessionFailures int
 }
 
 // NewApiCaller Creates a new ApiCaller
-func NewApiCaller(host, username, password string) *ApiCaller {
-	return &ApiCaller{
-		Server:   host,
-		Username: username,
-		Password: password,
+func NewApiCaller(pool PoolConfig) (*ApiCaller, error) {
+	if err := validateScheme(pool.Scheme); err != nil {
+		return nil, err
+	}
+	scheme := pool.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	var transport http.RoundTripper
+	var err error
+	if *replayDir != "" {
+		transport, err = newReplayer(recordingPath(*replayDir, pool.Name))
+	} else {
+		transport, err = newTransport(pool.TLSConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d := &ApiCaller{
+		Server:      pool.Xenhost,
+		Candidates:  pool.Xenhosts,
+		Scheme:      scheme,
+		Username:    pool.Credentials.Username,
+		credentials: pool.Credentials,
+	}
+	if *recordDir != "" {
+		transport = newRecorder(transport, recordingPath(*recordDir, pool.Name), d.redact)
+	}
+	d.transport = &certRecorder{
+		next:   transport,
+		expiry: map[string]time.Time{},
+	}
+	return d, nil
+}
+
+// validateScheme checks the scheme of a pool, an empty scheme is https
+func validateScheme(scheme string) error {
+	if scheme != "" && scheme != "https" && scheme != "http" {
+		return fmt.Errorf("unsupported scheme %q", scheme)
+	}
+	return nil
+}
+
+// validateConnection checks the scheme and loads the tls files of a pool or
+// module, a config with missing or broken files is rejected
+func validateConnection(scheme string, config TLSConfig) error {
+	if err := validateScheme(scheme); err != nil {
+		return err
+	}
+	_, err := newTransport(config)
+	return err
+}
+
+// apiError is a failed xen api call with its error description
+type apiError []string
+
+func (e apiError) Error() string {
+	return fmt.Sprintf("API Error: %v", []string(e))
+}
+
+// hostIsSlaveRegexp matches the master address of a HOST_IS_SLAVE error
+var hostIsSlaveRegexp = regexp.MustCompile(`HOST_IS_SLAVE ([^\s\]]+)`)
+
+// hostIsSlave returns the pool master named by a HOST_IS_SLAVE error
+func hostIsSlave(err error) (master string, ok bool) {
+	if err == nil {
+		return "", false
+	}
+	match := hostIsSlaveRegexp.FindStringSubmatch(err.Error())
+	if match == nil {
+		return "", false
 	}
+	return match[1], true
 }
 
 // ApiObject of type ..
 type ApiObject xsclient.XenAPIObject
 
-// NewXenAPIClient -
-func (d *ApiCaller) newXenAPIClient() (c xsclient.XenAPIClient, err error) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+// httpTimeout limits plain http requests to the xen hosts
+const httpTimeout = 30 * time.Second
+
+const (
+	// dialTimeout and tlsHandshakeTimeout bound the connection setup, a
+	// master dropping packets fails instead of stalling the scrape
+	dialTimeout         = 10 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+	// responseHeaderTimeout bounds the wait for the answer to a call, it has
+	// to stay above eventTimeout as event.from answers after that long
+	responseHeaderTimeout = httpTimeout
+)
+
+// newTransport creates the transport shared by the rpc client and plain http requests
+func newTransport(config TLSConfig) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CAFile != "" {
+		ca, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in ca file %s", config.CAFile)
+		}
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+	}, nil
+}
+
+// certRecorder remembers the certificate expiry of every host it talked to
+type certRecorder struct {
+	next   http.RoundTripper
+	mutex  sync.Mutex
+	expiry map[string]time.Time
+}
+
+// RoundTrip -
+func (r *certRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.next.RoundTrip(req)
+	if err == nil && resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		r.mutex.Lock()
+		r.expiry[req.URL.Host] = resp.TLS.PeerCertificates[0].NotAfter
+		r.mutex.Unlock()
 	}
+	return resp, err
+}
+
+// CertificateExpiry returns the certificate expiry by host
+func (d *ApiCaller) CertificateExpiry() map[string]time.Time {
+	d.transport.mutex.Lock()
+	defer d.transport.mutex.Unlock()
 
-	url, err := url.Parse("https://" + d.Server)
+	expiry := map[string]time.Time{}
+	for host, t := range d.transport.expiry {
+		expiry[host] = t
+	}
+	return expiry
+}
+
+// NewXenAPIClient -
+func (d *ApiCaller) newXenAPIClient(host string) (c xsclient.XenAPIClient, err error) {
+	url, err := url.Parse(d.Scheme + "://" + host)
 	if err != nil {
 		return c, err
 	}
 
-	rpcClient, err := xmlrpc.NewClient(url.String(), tr)
+	rpcClient, err := xmlrpc.NewClient(url.String(), d.transport)
 
 	return xsclient.XenAPIClient{
-		Host:     d.Server,
+		Host:     host,
 		Url:      url.String(),
 		RPC:      rpcClient,
 		Username: d.Username,
-		Password: d.Password,
 	}, err
 }
 
-// GetXenAPIClient returns
+// GetXenAPIClient returns the client of the current session and logs in if
+// there is none
 func (d *ApiCaller) GetXenAPIClient() (*xsclient.XenAPIClient, error) {
-	var err error
-	if d.xenAPIClient == nil {
-		c, err := d.newXenAPIClient()
+	d.loginMutex.Lock()
+	defer d.loginMutex.Unlock()
+
+	d.mutex.Lock()
+	closed, c, server := d.closed, d.xenAPIClient, d.Server
+	d.mutex.Unlock()
+
+	if closed {
+		// a scrape still running must not log in again
+		return nil, fmt.Errorf("logged out of %s", server)
+	}
+	if c == nil || c.Session == nil {
+		return d.login(c, server)
+	}
+	return c, nil
+}
+
+// login creates a new session on the pool master. The last known master is
+// tried first, then the candidates. A slave answering with HOST_IS_SLAVE
+// redirects the login to the master it names.
+// The client is replaced instead of changed, calls running with the old
+// session are not affected. It is called with loginMutex held.
+func (d *ApiCaller) login(current *xsclient.XenAPIClient, server string) (*xsclient.XenAPIClient, error) {
+	password, err := d.credentials.GetPassword()
+	if err != nil {
+		d.countSessionFailure()
+		return nil, fmt.Errorf("could not get password: %v", err)
+	}
+	d.passwordMutex.Lock()
+	d.password = password
+	d.passwordMutex.Unlock()
+
+	hosts := append([]string{server}, d.Candidates...)
+	tried := map[string]bool{}
+
+	for i := 0; i < len(hosts); i++ {
+		host := hosts[i]
+		if host == "" || tried[host] {
+			continue
+		}
+		tried[host] = true
+
+		var c *xsclient.XenAPIClient
+		c, err = d.loginTo(current, host, password)
+		if err == nil {
+			return d.replaceClient(c)
+		}
+
+		if master, ok := hostIsSlave(err); ok {
+			// try the master named by the slave next
+			rest := append([]string{master}, hosts[i+1:]...)
+			hosts = append(hosts[:i+1:i+1], rest...)
+		}
+	}
+	return nil, err
+}
+
+// replaceClient makes the client of a new session the current one. A session
+// created while the caller was logged out is ended at once.
+func (d *ApiCaller) replaceClient(c *xsclient.XenAPIClient) (*xsclient.XenAPIClient, error) {
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		c.RPC.Close()
+		// the rpc client may be the one closed by Logout, a fresh one ends
+		// the session
+		fresh, err := d.newXenAPIClient(c.Host)
+		if err == nil {
+			fresh.Session = c.Session
+			result := xsclient.APIResult{}
+			fresh.APICall(&result, "session.logout")
+			fresh.RPC.Close()
+		}
+		return nil, fmt.Errorf("logged out of %s", c.Host)
+	}
+	if c.Host != d.Server {
+		log.Printf("Pool master moved from %s to %s", d.Server, c.Host)
+		d.Server = c.Host
+	}
+	old := d.xenAPIClient
+	d.xenAPIClient = c
+	d.mutex.Unlock()
+
+	if old != nil && old.RPC != c.RPC {
+		old.RPC.Close()
+	}
+	return c, nil
+}
+
+// loginTo logs in to the given host. The rpc client is reused if the current
+// client is connected to this host. The password is removed from errors.
+func (d *ApiCaller) loginTo(current *xsclient.XenAPIClient, host string, password string) (*xsclient.XenAPIClient, error) {
+	var c xsclient.XenAPIClient
+	if current != nil && current.Host == host {
+		c = *current
+		c.Session = nil
+	} else {
+		var err error
+		c, err = d.newXenAPIClient(host)
 		if err != nil {
 			return nil, err
 		}
-		if err := c.Login(); err != nil {
-			return nil, err
+	}
+
+	d.mutex.Lock()
+	d.logins++
+	d.mutex.Unlock()
+	if err := loginSession(&c, password); err != nil {
+		d.countSessionFailure()
+		if current == nil || current.RPC != c.RPC {
+			c.RPC.Close()
+		}
+		return nil, redactPassword(err, password)
+	}
+	return &c, nil
+}
+
+// countSessionFailure counts a failed login
+func (d *ApiCaller) countSessionFailure() {
+	d.mutex.Lock()
+	d.sessionFailures++
+	d.mutex.Unlock()
+}
+
+// loginSession logs in like XenAPIClient.Login, but keeps the error
+// description, e.g. the master address of a HOST_IS_SLAVE error
+func loginSession(c *xsclient.XenAPIClient, password string) error {
+	result := xmlrpc.Struct{}
+	err := c.RPCCall(&result, "session.login_with_password", []interface{}{c.Username, password})
+	if err != nil {
+		return err
+	}
+
+	if result["Status"] != "Success" {
+		description := apiError{}
+		values, _ := result["ErrorDescription"].([]interface{})
+		for _, value := range values {
+			description = append(description, fmt.Sprint(value))
+		}
+		return description
+	}
+	if result["Value"] == nil {
+		return fmt.Errorf("login to %s returned no session", c.Host)
+	}
+	c.Session = result["Value"]
+	return nil
+}
+
+// invalidate drops the session of the client, the next call logs in again
+func (d *ApiCaller) invalidate(c *xsclient.XenAPIClient) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.xenAPIClient != c {
+		// someone else already renewed the session
+		return
+	}
+	d.sessionFailures++
+	invalid := *c
+	invalid.Session = nil
+	d.xenAPIClient = &invalid
+}
+
+// reconnect replaces a rpc client which was shut down after a connection
+// error, the session is kept
+func (d *ApiCaller) reconnect(c *xsclient.XenAPIClient) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.xenAPIClient != c {
+		return nil
+	}
+	fresh, err := d.newXenAPIClient(c.Host)
+	if err != nil {
+		return err
+	}
+	fresh.Session = c.Session
+	c.RPC.Close()
+	d.xenAPIClient = &fresh
+	return nil
+}
+
+// Logout ends the session and closes the rpc client, the caller can not be
+// used afterwards
+func (d *ApiCaller) Logout() error {
+	d.mutex.Lock()
+	d.closed = true
+	c := d.xenAPIClient
+	d.xenAPIClient = nil
+	d.mutex.Unlock()
+
+	if c == nil {
+		return nil
+	}
+	defer c.RPC.Close()
+
+	if c.Session == nil {
+		return nil
+	}
+	result := xsclient.APIResult{}
+	return c.APICall(&result, "session.logout")
+}
+
+// Master returns the host currently answering as pool master, it is empty
+// if there is no session
+func (d *ApiCaller) Master() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.xenAPIClient == nil || d.xenAPIClient.Session == nil {
+		return ""
+	}
+	return d.Server
+}
+
+// isSessionInvalid reports whether xen rejected a call because of an expired session
+func isSessionInvalid(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "SESSION_INVALID")
+}
+
+// redact removes the password of the current login from s
+func (d *ApiCaller) redact(s string) string {
+	d.passwordMutex.Lock()
+	password := d.password
+	d.passwordMutex.Unlock()
+
+	if password == "" {
+		return s
+	}
+	return strings.Replace(s, password, redacted, -1)
+}
+
+// isMethodUnknown reports whether the xen api does not know the called
+// method, e.g. of a class introduced by a later version
+func isMethodUnknown(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "MESSAGE_METHOD_UNKNOWN")
+}
+
+// GetHTTP fetches a http handler of a xen host with the current session,
+// e.g. /rrd_updates
+func (d *ApiCaller) GetHTTP(host string, path string, query url.Values) ([]byte, error) {
+	c, err := d.GetXenAPIClient()
+	if err != nil {
+		return nil, err
+	}
+	session, ok := c.Session.(string)
+	if !ok {
+		return nil, fmt.Errorf("no session for http request to %s", host)
+	}
+	query.Set("session_id", session)
+
+	u := url.URL{
+		Scheme:   d.Scheme,
+		Host:     host,
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+
+	client := &http.Client{
+		Transport: d.transport,
+		Timeout:   httpTimeout,
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		// do not log the url, it contains the session id
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("http request to %s%s failed: %v", host, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http request to %s%s failed: %s", host, path, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Logins returns the number of logins done by the caller
+func (d *ApiCaller) Logins() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.logins
+}
+
+// SessionFailures returns the number of failed logins and invalidated sessions
+func (d *ApiCaller) SessionFailures() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.sessionFailures
+}
+
+// call does a xen api call with the current session. Calls failing because of
+// an invalid session or a closed connection are retried once.
+func (d *ApiCaller) call(result *xsclient.APIResult, apikey string, params ...interface{}) error {
+	var err error
+	for try := 0; try < 2; try++ {
+		var c *xsclient.XenAPIClient
+		c, err = d.GetXenAPIClient()
+		if err != nil {
+			return err
+		}
+
+		err = c.APICall(result, apikey, params...)
+		switch {
+		case err == rpc.ErrShutdown:
+			if err := d.reconnect(c); err != nil {
+				return err
+			}
+		case isSessionInvalid(err):
+			d.invalidate(c)
+		case err != nil && strings.Contains(err.Error(), "HOST_IS_SLAVE"):
+			// the master moved, the next login follows it
+			d.invalidate(c)
+		default:
+			return err
 		}
-		d.xenAPIClient = &c
 	}
-	return d.xenAPIClient, err
+	return err
 }
 
 // GetSpecificValue -
 func (d *ApiCaller) GetSpecificValue(apikey string, params string) (interface{}, error) {
 	result := xsclient.APIResult{}
-	err := d.xenAPIClient.APICall(&result, apikey, params)
+	err := d.call(&result, apikey, params)
 
 	return result.Value, err
 }
 
+// ApiRecord is the record of a xen api object
+type ApiRecord map[string]interface{}
+
+// GetAllRecords returns the records of all objects of a class by reference
+// with a single call, e.g. for host.get_all_records
+func (d *ApiCaller) GetAllRecords(class string) (map[string]ApiRecord, error) {
+	result := xsclient.APIResult{}
+	err := d.call(&result, class+".get_all_records")
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := toRecord(result.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	records := map[string]ApiRecord{}
+	for ref, value := range values {
+		records[ref], err = toRecord(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// EventFrom waits up to timeout seconds for changes of the objects of the
+// classes since token. An empty token returns all objects of the classes.
+func (d *ApiCaller) EventFrom(classes []string, token string, timeout float64) (events []ApiRecord, nextToken string, err error) {
+	result := xsclient.APIResult{}
+	err = d.call(&result, "event.from", classes, token, timeout)
+	if err != nil {
+		return nil, token, err
+	}
+
+	batch, err := toRecord(result.Value)
+	if err != nil {
+		return nil, token, err
+	}
+	values, _ := batch["events"].([]interface{})
+	for _, value := range values {
+		event, err := toRecord(value)
+		if err != nil {
+			return nil, token, err
+		}
+		events = append(events, event)
+	}
+	nextToken, _ = batch["token"].(string)
+	return events, nextToken, nil
+}
+
+// toRecord converts a decoded xml-rpc struct into a record
+func toRecord(value interface{}) (ApiRecord, error) {
+	switch record := value.(type) {
+	case map[string]interface{}:
+		return ApiRecord(record), nil
+	case xmlrpc.Struct:
+		return ApiRecord(record), nil
+	}
+	return nil, fmt.Errorf("unexpected record type %T", value)
+}
+
 // GetMultiValues -
 func (d *ApiCaller) GetMultiValues(apikey string, params ...string) (apiObjects []*ApiObject, err error) {
 	result := xsclient.APIResult{}
 
 	if len(params) > 0 {
-		err = d.xenAPIClient.APICall(&result, apikey, params[0])
+		err = d.call(&result, apikey, params[0])
 	} else {
-		err = d.xenAPIClient.APICall(&result, apikey)
+		err = d.call(&result, apikey)
 	}
 
 	if err != nil {
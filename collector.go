@@ -1,90 +1,478 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// defaultHostConcurrency is the number of hosts of a pool collected at the
+// same time if no host concurrency is configured
+const defaultHostConcurrency = 4
+
 // Exporter implements the prometheus.Collector interface. It exposes the metrics
 // of a ipmi node.
 type Exporter struct {
+	configMutex  sync.RWMutex
 	config       Config
-	metrics      []*prometheus.GaugeVec
+	descs        *xenDescs
 	totalScrapes prometheus.Counter
+	scrapeErrors *prometheus.CounterVec
+	objectErrors *prometheus.CounterVec
 	replacer     *strings.Replacer
+
+	targetsMutex sync.Mutex
+	targets      map[string]*target
+
+	resultsMutex sync.Mutex
+	results      map[string]*poolResult
+
+	// loopMutex guards the stop channel of the background refresh, loops
+	// counts the refresh loops still running
+	loopMutex sync.Mutex
+	stop      chan struct{}
+	loops     sync.WaitGroup
+
+	upDesc                *prometheus.Desc
+	scrapeDurationDesc    *prometheus.Desc
+	lastScrapeSuccessDesc *prometheus.Desc
+	loginsDesc            *prometheus.Desc
+	sessionFailuresDesc   *prometheus.Desc
+	poolMasterDesc        *prometheus.Desc
+	certExpiryDesc        *prometheus.Desc
+	cacheSyncedDesc       *prometheus.Desc
+	cacheAgeDesc          *prometheus.Desc
+	cacheLagDesc          *prometheus.Desc
+	cacheResyncsDesc      *prometheus.Desc
+	resultAgeDesc         *prometheus.Desc
+	refreshFailuresDesc   *prometheus.Desc
+}
+
+// target holds the state of a pool which is kept between scrapes
+type target struct {
+	pool       PoolConfig
+	caller     *ApiCaller
+	cache      *EventCache
+	collectors []namedCollector
 }
 
 // Config -
 type Config struct {
-	Xenhost string
+	// Xenhost, Credentials, Scheme and TLSConfig describe a single pool and
+	// are kept for configs written before Pools existed
+	Xenhost     string
+	Credentials Credentials
+	Scheme      string
+	TLSConfig   TLSConfig `yaml:"tls_config"`
+	EventCache  bool      `yaml:"event_cache"`
+
+	Pools []PoolConfig
+
+	// Collectors switches collectors on or off for all pools
+	Collectors map[string]bool
+
+	// RefreshInterval scrapes the pools in the background, scrapes are answered
+	// with the last results. Results older than MaxStaleness are dropped.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	MaxStaleness    time.Duration `yaml:"max_staleness"`
+
+	// HostConcurrency limits the hosts of a pool whose rrd data is fetched at
+	// the same time
+	HostConcurrency int `yaml:"host_concurrency"`
+
+	// Modules hold the credentials used by the /probe endpoint
+	Modules map[string]Module
+}
+
+// TLSConfig configures the tls connection to the xen api
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// PoolConfig describes one xen pool the exporter scrapes. Xenhosts lists
+// further hosts of the pool which are tried if Xenhost is not the pool master.
+// Scheme is https unless set to http. With EventCache the records of the
+// pool are kept current in the background instead of being fetched per scrape.
+type PoolConfig struct {
+	Name        string
+	Xenhost     string
+	Xenhosts    []string
+	Credentials Credentials
+	Scheme      string
+	TLSConfig   TLSConfig `yaml:"tls_config"`
+	Collectors  map[string]bool
+	EventCache  bool `yaml:"event_cache"`
+}
 
-	Credentials struct {
-		Username string
-		Password string
+// Module describes how to connect to a target passed to the /probe endpoint.
+// AllowedTargets is a regular expression the targets have to match, the
+// credentials of the module are not sent to other hosts.
+type Module struct {
+	Credentials    Credentials
+	Scheme         string
+	TLSConfig      TLSConfig `yaml:"tls_config"`
+	Collectors     map[string]bool
+	AllowedTargets string `yaml:"allowed_targets"`
+}
+
+// allowedTargets returns the anchored pattern of the allowed targets, it is
+// nil if all targets are allowed
+func (m Module) allowedTargets() (*regexp.Regexp, error) {
+	if m.AllowedTargets == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile("^(?:" + m.AllowedTargets + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed_targets: %v", err)
 	}
+	return re, nil
 }
 
-// NewExporter instantiates a new ipmi Exporter.
-func NewExporter(config Config) *Exporter {
-	var e = &Exporter{
-		config: config,
+// GetPools returns all configured pools, including the legacy single pool
+func (c Config) GetPools() []PoolConfig {
+	pools := []PoolConfig{}
+	if c.Xenhost != "" {
+		pools = append(pools, PoolConfig{
+			Name:        c.Xenhost,
+			Xenhost:     c.Xenhost,
+			Credentials: c.Credentials,
+			Scheme:      c.Scheme,
+			TLSConfig:   c.TLSConfig,
+			EventCache:  c.EventCache,
+		})
+	}
+
+	for _, pool := range c.Pools {
+		if pool.Xenhost == "" && len(pool.Xenhosts) > 0 {
+			pool.Xenhost = pool.Xenhosts[0]
+		}
+		if pool.Name == "" {
+			pool.Name = pool.Xenhost
+		}
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
+// validatePools checks that every pool has a xenhost and a name of its own,
+// pools sharing a name would share their session and series
+func (c Config) validatePools() error {
+	names := map[string]bool{}
+	for i, pool := range c.GetPools() {
+		if pool.Xenhost == "" {
+			return fmt.Errorf("pool %d has no xenhost", i+1)
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("pool name %s is used more than once", pool.Name)
+		}
+		names[pool.Name] = true
 	}
+	return nil
+}
 
-	e.metrics = []*prometheus.GaugeVec{}
+// NewExporter instantiates a new ipmi Exporter. With a refresh interval the
+// pools are scraped in the background until Close is called.
+func NewExporter(config Config) *Exporter {
+	e := &Exporter{
+		config:  config,
+		descs:   newXenDescs(),
+		targets: map[string]*target{},
+		results: map[string]*poolResult{},
+		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: *namespace,
+			Name:      "exporter_scrapes_total",
+			Help:      "Current total xen scrapes.",
+		}),
+		scrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: *namespace,
+			Name:      "scrape_errors_total",
+			Help:      "Number of failed scrapes by collector",
+		}, []string{"pool", "collector"}),
+		objectErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: *namespace,
+			Name:      "object_errors_total",
+			Help:      "Number of objects skipped because of errors by collector and class",
+		}, []string{"pool", "collector", "class"}),
+		upDesc:                newDesc("up", "Whether the xen api of the pool could be reached", ""),
+		scrapeDurationDesc:    newDesc("scrape_duration_seconds", "Duration of the last scrape by collector", "", "collector"),
+		lastScrapeSuccessDesc: newDesc("last_scrape_success", "Whether the last scrape of the collector succeeded", "", "collector"),
+		loginsDesc:            newDesc("session_logins_total", "Number of logins to the xen api", ""),
+		sessionFailuresDesc:   newDesc("session_failures_total", "Number of failed logins and sessions invalidated by the xen api", ""),
+		poolMasterDesc:        newDesc("pool_master_info", "Host currently answering as pool master", "", "host"),
+		certExpiryDesc:        newDesc("tls_certificate_expiry_seconds", "Expiry of the tls certificate of the xen api endpoint as unix timestamp", "", "host"),
+		cacheSyncedDesc:       newDesc("event_cache_synced", "Whether the event cache of the pool is in sync", ""),
+		cacheAgeDesc:          newDesc("event_cache_age_seconds", "Time since the event cache of the pool was last updated", ""),
+		cacheLagDesc:          newDesc("event_cache_lag_seconds", "Delay between the last events and their arrival in the event cache", ""),
+		cacheResyncsDesc:      newDesc("event_cache_resyncs_total", "Number of times the event cache of the pool was synced from scratch", ""),
+		resultAgeDesc:         newDesc("result_age_seconds", "Time since the served results of the pool were refreshed", ""),
+		refreshFailuresDesc:   newDesc("refresh_failures", "Number of refreshes of the pool failed in a row", ""),
+	}
 
-	e.collect()
+	e.startRefresh(config.RefreshInterval)
 	return e
 }
 
+// getConfig returns the active config
+func (e *Exporter) getConfig() Config {
+	e.configMutex.RLock()
+	defer e.configMutex.RUnlock()
+	return e.config
+}
+
+// Reload replaces the config of the exporter. Pools whose config did not
+// change keep their sessions, caches and collector state. Removed and
+// changed pools are logged out, changed pools log in again on the next scrape.
+func (e *Exporter) Reload(config Config) {
+	e.configMutex.Lock()
+	old := e.config
+	e.config = config
+	e.configMutex.Unlock()
+
+	if config.RefreshInterval != old.RefreshInterval {
+		e.startRefresh(config.RefreshInterval)
+	}
+
+	pools := map[string]PoolConfig{}
+	for _, pool := range config.GetPools() {
+		pools[pool.Name] = pool
+	}
+	oldPools := map[string]PoolConfig{}
+	for _, pool := range old.GetPools() {
+		oldPools[pool.Name] = pool
+	}
+	collectorsKept := reflect.DeepEqual(config.Collectors, old.Collectors)
+
+	e.targetsMutex.Lock()
+	removed := map[string]*target{}
+	for name, t := range e.targets {
+		pool, ok := pools[name]
+		if ok && reflect.DeepEqual(pool, t.pool) && collectorsKept {
+			continue
+		}
+		removed[name] = t
+		delete(e.targets, name)
+	}
+	e.targetsMutex.Unlock()
+
+	// the results of changed pools were collected with the old config
+	e.resultsMutex.Lock()
+	for name := range e.results {
+		pool, ok := pools[name]
+		if ok && reflect.DeepEqual(pool, oldPools[name]) && collectorsKept {
+			continue
+		}
+		delete(e.results, name)
+	}
+	e.resultsMutex.Unlock()
+
+	closeTargets(removed)
+}
+
 // Describe Describes all the registered stats metrics from the xen master.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	for _, m := range e.metrics {
-		m.Describe(ch)
-	}
+	e.descs.Describe(ch)
+	ch <- e.upDesc
+	ch <- e.scrapeDurationDesc
+	ch <- e.lastScrapeSuccessDesc
+	ch <- e.loginsDesc
+	ch <- e.sessionFailuresDesc
+	ch <- e.poolMasterDesc
+	ch <- e.certExpiryDesc
+	ch <- e.cacheSyncedDesc
+	ch <- e.cacheAgeDesc
+	ch <- e.cacheLagDesc
+	ch <- e.cacheResyncsDesc
+	ch <- e.resultAgeDesc
+	ch <- e.refreshFailuresDesc
+	e.totalScrapes.Describe(ch)
+	e.scrapeErrors.Describe(ch)
+	e.objectErrors.Describe(ch)
 }
 
 // Collect collects all the registered stats metrics from the xen master.
 func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
-	e.collect()
+	config := e.getConfig()
+	if config.RefreshInterval > 0 {
+		e.collectResults(metrics, config)
+	} else {
+		e.totalScrapes.Inc()
+		// the pools are scraped at the same time, a slow pool does not
+		// delay the others
+		var wg sync.WaitGroup
+		for _, pool := range config.GetPools() {
+			wg.Add(1)
+			go func(pool PoolConfig) {
+				defer wg.Done()
+				e.collectPool(pool, metrics)
+			}(pool)
+		}
+		wg.Wait()
+	}
 
-	for _, m := range e.metrics {
-		m.Collect(metrics)
+	e.totalScrapes.Collect(metrics)
+	e.scrapeErrors.Collect(metrics)
+	e.objectErrors.Collect(metrics)
+
+	// the targets are copied, a pool waiting for its master does not block
+	// the targets of the others
+	e.targetsMutex.Lock()
+	targets := make(map[string]*target, len(e.targets))
+	for pool, t := range e.targets {
+		targets[pool] = t
+	}
+	e.targetsMutex.Unlock()
+
+	for pool, t := range targets {
+		metrics <- prometheus.MustNewConstMetric(e.loginsDesc, prometheus.CounterValue, float64(t.caller.Logins()), pool)
+		metrics <- prometheus.MustNewConstMetric(e.sessionFailuresDesc, prometheus.CounterValue, float64(t.caller.SessionFailures()), pool)
+		if master := t.caller.Master(); master != "" {
+			metrics <- prometheus.MustNewConstMetric(e.poolMasterDesc, prometheus.GaugeValue, 1, pool, master)
+		}
+		for host, expiry := range t.caller.CertificateExpiry() {
+			metrics <- prometheus.MustNewConstMetric(e.certExpiryDesc, prometheus.GaugeValue, float64(expiry.Unix()), pool, host)
+		}
+		if t.cache != nil {
+			synced, lastUpdate, lag, resyncs := t.cache.Status()
+			metrics <- prometheus.MustNewConstMetric(e.cacheSyncedDesc, prometheus.GaugeValue, Btof(synced), pool)
+			if !lastUpdate.IsZero() {
+				metrics <- prometheus.MustNewConstMetric(e.cacheAgeDesc, prometheus.GaugeValue, time.Since(lastUpdate).Seconds(), pool)
+			}
+			metrics <- prometheus.MustNewConstMetric(e.cacheLagDesc, prometheus.GaugeValue, lag.Seconds(), pool)
+			metrics <- prometheus.MustNewConstMetric(e.cacheResyncsDesc, prometheus.CounterValue, float64(resyncs), pool)
+		}
 	}
 }
 
-func (e *Exporter) collect() {
-	var err error
+// Close stops the background refresh and the event caches and logs out of
+// all sessions
+func (e *Exporter) Close() {
+	e.stopRefresh()
 
-	stats := NewXenstats(e.config)
-	stats.GetApiCaller()
+	e.targetsMutex.Lock()
+	defer e.targetsMutex.Unlock()
+	closeTargets(e.targets)
+}
 
-	e.metrics, err = stats.createHostMemMetrics()
-	if err != nil {
-		log.Printf("Xen api error in creating host memory metrics: %v", err)
+// closeTargets stops the event caches of the targets and logs out of their
+// sessions
+func closeTargets(targets map[string]*target) {
+	// the caches stop after their pending event.from, they are stopped at once
+	for _, t := range targets {
+		if t.cache != nil {
+			t.cache.Stop()
+		}
+	}
+	for pool, t := range targets {
+		if err := t.caller.Logout(); err != nil {
+			log.Printf("Error during logout of pool %s: %v", pool, err)
+		}
+		if t.cache != nil {
+			if err := t.cache.Wait(); err != nil {
+				log.Printf("Error during logout of the event cache of pool %s: %v", pool, err)
+			}
+		}
 	}
+}
 
-	poolmetrics, err := stats.createPoolMetrics()
-	if err != nil {
-		log.Printf("Xen api error in creating ha pool metrics: %v", err)
+// target returns the state kept between the scrapes of a pool. Scrapes
+// started before a reload can not bring back a pool which was removed or
+// changed in between.
+func (e *Exporter) target(pool PoolConfig) (*target, error) {
+	e.targetsMutex.Lock()
+	defer e.targetsMutex.Unlock()
+
+	config := e.getConfig()
+	if current, ok := configuredPool(config, pool.Name); !ok || !reflect.DeepEqual(current, pool) {
+		return nil, fmt.Errorf("the pool was changed by a reload")
 	}
-	e.metrics = append(e.metrics, poolmetrics...)
 
-	storagemetrics, err := stats.createStorageMetrics()
-	if err != nil {
-		log.Printf("Xen api error in creating storage metrics: %v", err)
+	t, ok := e.targets[pool.Name]
+	if ok && !reflect.DeepEqual(t.pool, pool) {
+		log.Printf("Config of pool %s changed, logging out", pool.Name)
+		go closeTargets(map[string]*target{pool.Name: t})
+		ok = false
+	}
+	if !ok {
+		caller, err := NewApiCaller(pool)
+		if err != nil {
+			return nil, err
+		}
+		t = &target{
+			pool:       pool,
+			caller:     caller,
+			collectors: newCollectors(config.Collectors, pool.Collectors),
+		}
+		if pool.EventCache {
+			cacheCaller, err := NewApiCaller(pool)
+			if err != nil {
+				return nil, err
+			}
+			t.cache = NewEventCache(pool.Name, cacheCaller)
+		}
+		e.targets[pool.Name] = t
+	}
+	return t, nil
+}
+
+// configuredPool returns the pool of the given name of a config
+func configuredPool(config Config, name string) (PoolConfig, bool) {
+	for _, pool := range config.GetPools() {
+		if pool.Name == name {
+			return pool, true
+		}
 	}
-	e.metrics = append(e.metrics, storagemetrics...)
+	return PoolConfig{}, false
+}
 
-	cpumetrics, err := stats.createHostCPUMetrics()
+// collectPool scrapes a single pool and returns whether the pool answered,
+// i.e. it was up and at least one collector succeeded. Errors are logged and
+// only affect the metrics of this pool.
+func (e *Exporter) collectPool(pool PoolConfig, ch chan<- prometheus.Metric) bool {
+	t, err := e.target(pool)
 	if err != nil {
-		log.Printf("Xen api error in creating host cpu metrics: %v", err)
+		log.Printf("Invalid config of pool %s: %v", pool.Name, err)
+		ch <- prometheus.MustNewConstMetric(e.upDesc, prometheus.GaugeValue, 0, pool.Name)
+		return false
 	}
-	e.metrics = append(e.metrics, cpumetrics...)
-
-	err = stats.CloseApi()
+	stats, err := NewXenstats(pool.Name, t.caller, e.descs, t.cache)
 	if err != nil {
-		log.Printf("Error during connection close: %v", err)
+		log.Printf("Could not connect to pool %s: %v", pool.Name, err)
+		ch <- prometheus.MustNewConstMetric(e.upDesc, prometheus.GaugeValue, 0, pool.Name)
+		return false
+	}
+	ch <- prometheus.MustNewConstMetric(e.upDesc, prometheus.GaugeValue, 1, pool.Name)
+
+	stats.hostConcurrency = e.getConfig().HostConcurrency
+	if stats.hostConcurrency <= 0 {
+		stats.hostConcurrency = defaultHostConcurrency
+	}
+	stats.objectErrors = e.objectErrors
+
+	answered := len(t.collectors) == 0
+	for _, c := range t.collectors {
+		stats.collector = c.name
+		start := time.Now()
+		err := c.collector.Update(stats, ch)
+		ch <- prometheus.MustNewConstMetric(e.scrapeDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds(), pool.Name, c.name)
+		ch <- prometheus.MustNewConstMetric(e.lastScrapeSuccessDesc, prometheus.GaugeValue, Btof(err == nil), pool.Name, c.name)
+		scrapeErrors := e.scrapeErrors.WithLabelValues(pool.Name, c.name)
+		if err != nil {
+			log.Printf("Xen api error in creating %s metrics of pool %s: %v", c.name, pool.Name, err)
+			scrapeErrors.Inc()
+		} else {
+			answered = true
+		}
 	}
+	stats.createRPCCallsMetric(ch)
+	return answered
 }
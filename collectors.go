@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// XenCollector is a part of a pool scrape which can be switched on and off.
+// A collector is created per pool, so it may keep state between scrapes.
+type XenCollector interface {
+	Update(stats *Xenstats, ch chan<- prometheus.Metric) error
+}
+
+// collectorFunc adapts a metrics function of Xenstats to a XenCollector
+type collectorFunc func(s Xenstats, ch chan<- prometheus.Metric) error
+
+// Update -
+func (f collectorFunc) Update(stats *Xenstats, ch chan<- prometheus.Metric) error {
+	return f(*stats, ch)
+}
+
+// collectorFactory creates the instances of a registered collector
+type collectorFactory struct {
+	enabled *bool
+	create  func() XenCollector
+}
+
+var collectorFactories = map[string]collectorFactory{}
+
+// registerCollector makes a collector available under the given name. It adds
+// the -collector.<name> flag to switch the collector on or off.
+func registerCollector(name string, isDefaultEnabled bool, create func() XenCollector) {
+	enabled := flag.Bool("collector."+name, isDefaultEnabled, fmt.Sprintf("Enable the %s collector.", name))
+	collectorFactories[name] = collectorFactory{
+		enabled: enabled,
+		create:  create,
+	}
+}
+
+func init() {
+	registerCollector("host_memory", true, func() XenCollector { return collectorFunc(Xenstats.createHostMemMetrics) })
+	registerCollector("pool", true, func() XenCollector { return collectorFunc(Xenstats.createPoolMetrics) })
+	registerCollector("storage", true, func() XenCollector { return collectorFunc(Xenstats.createStorageMetrics) })
+	registerCollector("host_cpu", true, func() XenCollector { return collectorFunc(Xenstats.createHostCPUMetrics) })
+	registerCollector("vm", true, func() XenCollector { return collectorFunc(Xenstats.createVMMetrics) })
+}
+
+// namedCollector is an instance of a registered collector
+type namedCollector struct {
+	name      string
+	collector XenCollector
+}
+
+// validateCollectors checks that all collectors switched in the config exist
+func validateCollectors(collectors map[string]bool) error {
+	for name := range collectors {
+		if _, ok := collectorFactories[name]; !ok {
+			return fmt.Errorf("unknown collector %q", name)
+		}
+	}
+	return nil
+}
+
+// isCollectorEnabled decides if a collector runs for a pool. A flag given on
+// the command line wins over the pool config, the pool config over the global
+// config and the global config over the default of the collector.
+func isCollectorEnabled(name string, global, pool map[string]bool) bool {
+	commandLine := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "collector."+name {
+			commandLine = true
+		}
+	})
+
+	factory := collectorFactories[name]
+	if commandLine {
+		return *factory.enabled
+	}
+	if enabled, ok := pool[name]; ok {
+		return enabled
+	}
+	if enabled, ok := global[name]; ok {
+		return enabled
+	}
+	return *factory.enabled
+}
+
+// newCollectors creates the enabled collectors of a pool, sorted by name
+func newCollectors(global, pool map[string]bool) []namedCollector {
+	names := []string{}
+	for name := range collectorFactories {
+		if isCollectorEnabled(name, global, pool) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	collectors := []namedCollector{}
+	for _, name := range names {
+		collectors = append(collectors, namedCollector{
+			name:      name,
+			collector: collectorFactories[name].create(),
+		})
+	}
+	return collectors
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// passwordCommandTimeout limits the runtime of a password command
+const passwordCommandTimeout = 10 * time.Second
+
+// redacted replaces passwords in errors
+const redacted = "<redacted>"
+
+// Credentials hold the login of a pool. The password is either given in the
+// config or taken from an environment variable, a file or the output of a
+// command. It is looked up at every login, so a changed file or secret is
+// used once the session is renewed.
+type Credentials struct {
+	Username        string
+	Password        string
+	PasswordEnv     string   `yaml:"password_env"`
+	PasswordFile    string   `yaml:"password_file"`
+	PasswordCommand []string `yaml:"password_command"`
+}
+
+// validate checks that at most one source of the password is given
+func (c Credentials) validate() error {
+	sources := 0
+	for _, set := range []bool{c.Password != "", c.PasswordEnv != "", c.PasswordFile != "", len(c.PasswordCommand) > 0} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.New("only one of password, password_env, password_file and password_command can be set")
+	}
+	return nil
+}
+
+// GetPassword returns the password from the configured source
+func (c Credentials) GetPassword() (string, error) {
+	switch {
+	case c.PasswordEnv != "":
+		password, ok := os.LookupEnv(c.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", c.PasswordEnv)
+		}
+		return password, nil
+
+	case c.PasswordFile != "":
+		password, err := ioutil.ReadFile(c.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("could not read password file: %v", err)
+		}
+		return strings.TrimRight(string(password), "\r\n"), nil
+
+	case len(c.PasswordCommand) > 0:
+		ctx, cancel := context.WithTimeout(context.Background(), passwordCommandTimeout)
+		defer cancel()
+
+		var stdout bytes.Buffer
+		cmd := exec.CommandContext(ctx, c.PasswordCommand[0], c.PasswordCommand[1:]...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		// the output is not part of the error, it is the password
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("password command %s failed: %v", c.PasswordCommand[0], err)
+		}
+		return strings.TrimRight(stdout.String(), "\r\n"), nil
+	}
+	return c.Password, nil
+}
+
+// redactPassword removes the password from an error, xen api faults may
+// repeat the parameters of the failed call
+func redactPassword(err error, password string) error {
+	if err == nil || password == "" || !strings.Contains(err.Error(), password) {
+		return err
+	}
+	return errors.New(strings.Replace(err.Error(), password, redacted, -1))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetPassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xenstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+	err = ioutil.WriteFile(passwordFile, []byte("from-file\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("XENSTATS_TEST_PASSWORD", "from-env")
+	defer os.Unsetenv("XENSTATS_TEST_PASSWORD")
+
+	tests := []struct {
+		credentials Credentials
+		password    string
+	}{
+		{Credentials{Password: "from-config"}, "from-config"},
+		{Credentials{PasswordEnv: "XENSTATS_TEST_PASSWORD"}, "from-env"},
+		{Credentials{PasswordFile: passwordFile}, "from-file"},
+		{Credentials{PasswordCommand: []string{"echo", "from-command"}}, "from-command"},
+	}
+	for _, test := range tests {
+		password, err := test.credentials.GetPassword()
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.credentials, err)
+			continue
+		}
+		if password != test.password {
+			t.Errorf("%+v: expected %q, got %q", test.credentials, test.password, password)
+		}
+	}
+
+	for _, credentials := range []Credentials{
+		{PasswordEnv: "XENSTATS_TEST_UNSET"},
+		{PasswordFile: filepath.Join(dir, "missing")},
+		{PasswordCommand: []string{"false"}},
+	} {
+		if _, err := credentials.GetPassword(); err == nil {
+			t.Errorf("%+v: expected an error", credentials)
+		}
+	}
+}
+
+func TestCredentialsValidate(t *testing.T) {
+	if err := (Credentials{Username: "root", PasswordFile: "/run/secrets/xen"}).validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (Credentials{Password: "secret", PasswordEnv: "XEN_PASSWORD"}).validate(); err == nil {
+		t.Errorf("expected an error for two password sources")
+	}
+}
+
+func TestRedactPassword(t *testing.T) {
+	err := redactPassword(errors.New("API Error: [SESSION_AUTHENTICATION_FAILED root secret]"), "secret")
+	if err.Error() != "API Error: [SESSION_AUTHENTICATION_FAILED root <redacted>]" {
+		t.Errorf("password not redacted: %v", err)
+	}
+	if redactPassword(nil, "secret") != nil {
+		t.Errorf("expected nil to stay nil")
+	}
+}
+
+func TestLoginRereadsPasswordFile(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+
+	dir, err := ioutil.TempDir("", "xenstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+	err = ioutil.WriteFile(passwordFile, []byte("outdated"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := testConfig(mock.Address()).Pools[0]
+	pool.Credentials = Credentials{Username: "root", PasswordFile: passwordFile}
+	caller, err := NewApiCaller(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Logout()
+
+	_, err = caller.GetXenAPIClient()
+	if err == nil {
+		t.Fatalf("expected the login to fail")
+	}
+	if strings.Contains(err.Error(), "outdated") {
+		t.Errorf("error contains the password: %v", err)
+	}
+
+	err = ioutil.WriteFile(passwordFile, []byte("secret"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = caller.GetXenAPIClient()
+	if err != nil {
+		t.Errorf("expected the login with the new password to succeed: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	registerCollector("disk", true, func() XenCollector { return collectorFunc(Xenstats.createDiskMetrics) })
+}
+
+// createDiskMetrics exports the virtual disks of the storages. A disk carries
+// the labels of the vm it is plugged into, disks shared by several vms are
+// reported with the first one and orphaned disks with empty vm labels.
+func (s Xenstats) createDiskMetrics(ch chan<- prometheus.Metric) error {
+	vdis, err := s.getAllRecords("VDI")
+	if err != nil {
+		return err
+	}
+	vbds, err := s.getAllRecords("VBD")
+	if err != nil {
+		return err
+	}
+	storages, err := s.getAllRecords("SR")
+	if err != nil {
+		return err
+	}
+	vms, err := s.getAllRecords("VM")
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range sortedRefs(vdis) {
+		vdi := vdis[ref]
+		storage := storages[recordString(vdi, "SR")]
+		diskLabels := []string{
+			recordString(storage, "name_label"),
+			recordString(storage, "uuid"),
+			recordString(vdi, "name_label"),
+			recordString(vdi, "uuid"),
+		}
+
+		// vbds destroyed in between the calls are skipped
+		diskVBDs := map[string]ApiRecord{}
+		for _, vbdRef := range recordRefs(vdi, "VBDs") {
+			if vbd, ok := vbds[vbdRef]; ok {
+				diskVBDs[vbdRef] = vbd
+			}
+		}
+		vbdRefs := sortedRefs(diskVBDs)
+
+		var owner ApiRecord
+		if len(vbdRefs) > 0 {
+			owner = vms[recordString(diskVBDs[vbdRefs[0]], "VM")]
+		}
+		labels := append(diskLabels, recordString(owner, "name_label"), recordString(owner, "uuid"))
+
+		virtualSize, err := recordInt(vdi, "virtual_size")
+		if err != nil {
+			s.objectError("VDI", diskLabels[2], err)
+			continue
+		}
+		physicalUtilisation, err := recordInt(vdi, "physical_utilisation")
+		if err != nil {
+			s.objectError("VDI", diskLabels[2], err)
+			continue
+		}
+
+		s.gauge(ch, s.descs.vdiVirtualSize, float64(virtualSize), labels...)
+		s.gauge(ch, s.descs.vdiPhysicalUtilisation, float64(physicalUtilisation), labels...)
+		s.gauge(ch, s.descs.vdiSharable, Btof(recordBool(vdi, "sharable")), labels...)
+		s.gauge(ch, s.descs.vdiReadOnly, Btof(recordBool(vdi, "read_only")), labels...)
+		s.gauge(ch, s.descs.vdiIsSnapshot, Btof(recordBool(vdi, "is_a_snapshot")), labels...)
+		s.gauge(ch, s.descs.vdiVBDs, float64(len(vbdRefs)), labels...)
+
+		for _, vbdRef := range vbdRefs {
+			vbd := diskVBDs[vbdRef]
+			vm := vms[recordString(vbd, "VM")]
+			vbdLabels := append(append([]string{}, diskLabels...), recordString(vm, "name_label"), recordString(vm, "uuid"), recordString(vbd, "userdevice"))
+			s.gauge(ch, s.descs.vbdAttached, Btof(recordBool(vbd, "currently_attached")), vbdLabels...)
+		}
+	}
+	return nil
+}
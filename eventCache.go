@@ -0,0 +1,176 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventCacheClasses are kept current by the event cache, the records of all
+// other classes are still fetched on every scrape
+var eventCacheClasses = []string{"host", "host_metrics", "pool", "SR", "VM", "VM_metrics", "VM_guest_metrics"}
+
+const (
+	// eventTimeout is the time in seconds event.from waits for changes, it has
+	// to stay below responseHeaderTimeout
+	eventTimeout = 10.0
+	// eventRetryInterval is the wait after a failed event.from before the
+	// cache is synced again
+	eventRetryInterval = 10 * time.Second
+)
+
+// EventCache keeps the records of a pool current by long-polling event.from
+// in the background. It uses a session of its own, so scrapes are not blocked
+// by the long-polls.
+type EventCache struct {
+	pool   string
+	caller *ApiCaller
+	stop   chan struct{}
+	done   chan struct{}
+
+	mutex      sync.RWMutex
+	records    map[string]map[string]ApiRecord
+	synced     bool
+	lastUpdate time.Time
+	lag        time.Duration
+	resyncs    int
+}
+
+// NewEventCache creates the cache of a pool and starts to sync it
+func NewEventCache(pool string, caller *ApiCaller) *EventCache {
+	c := &EventCache{
+		pool:    pool,
+		caller:  caller,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		records: map[string]map[string]ApiRecord{},
+	}
+	go c.run()
+	return c
+}
+
+// run applies the events until the cache is stopped. An empty token fetches
+// all objects, so the cache starts from scratch whenever the token is lost.
+func (c *EventCache) run() {
+	defer close(c.done)
+
+	token := ""
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+
+		events, nextToken, err := c.caller.EventFrom(eventCacheClasses, token, eventTimeout)
+		if err != nil {
+			log.Printf("Event cache of pool %s is out of sync: %v", c.pool, err)
+			c.mutex.Lock()
+			c.synced = false
+			c.mutex.Unlock()
+			token = ""
+
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(eventRetryInterval):
+			}
+			continue
+		}
+
+		c.apply(events, token == "")
+		token = nextToken
+	}
+}
+
+// apply updates the records with a batch of events, a full batch replaces
+// all records
+func (c *EventCache) apply(events []ApiRecord, full bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if full {
+		if !c.lastUpdate.IsZero() {
+			c.resyncs++
+		}
+		c.records = map[string]map[string]ApiRecord{}
+	}
+
+	var newest time.Time
+	for _, event := range events {
+		class := strings.ToLower(recordString(event, "class"))
+		ref := recordString(event, "ref")
+		if c.records[class] == nil {
+			c.records[class] = map[string]ApiRecord{}
+		}
+
+		if recordString(event, "operation") == "del" {
+			delete(c.records[class], ref)
+		} else {
+			snapshot, err := toRecord(event["snapshot"])
+			if err != nil {
+				log.Printf("Event cache of pool %s got an invalid %s record: %v", c.pool, class, err)
+				continue
+			}
+			c.records[class][ref] = snapshot
+		}
+
+		if timestamp, err := recordTime(event, "timestamp"); err == nil && timestamp.After(newest) {
+			newest = timestamp
+		}
+	}
+
+	// the initial events carry the creation time of the objects
+	if !full && !newest.IsZero() {
+		c.lag = now.Sub(newest)
+	}
+	c.synced = true
+	c.lastUpdate = now
+}
+
+// Records returns a copy of the cached records of a class. ok is false if the
+// class is not cached or the cache is not in sync.
+func (c *EventCache) Records(class string) (records map[string]ApiRecord, ok bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if !c.synced {
+		return nil, false
+	}
+	cached := false
+	for _, cachedClass := range eventCacheClasses {
+		if cachedClass == class {
+			cached = true
+		}
+	}
+	if !cached {
+		return nil, false
+	}
+
+	records = map[string]ApiRecord{}
+	for ref, record := range c.records[strings.ToLower(class)] {
+		records[ref] = record
+	}
+	return records, true
+}
+
+// Status returns whether the cache is in sync, the time of its last update,
+// the delay of the last events and the number of resyncs
+func (c *EventCache) Status() (synced bool, lastUpdate time.Time, lag time.Duration, resyncs int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.synced, c.lastUpdate, c.lag, c.resyncs
+}
+
+// Stop tells the cache to stop syncing, Wait waits for it
+func (c *EventCache) Stop() {
+	close(c.stop)
+}
+
+// Wait waits until the cache stopped and logs out of its session
+func (c *EventCache) Wait() error {
+	<-c.done
+	return c.caller.Logout()
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// volatileMetrics change with every run and are left out of the golden files
+var volatileMetrics = map[string]bool{
+	"xenstats_scrape_duration_seconds":        true,
+	"xenstats_tls_certificate_expiry_seconds": true,
+	"xenstats_pool_master_info":               true,
+	"xenstats_host_uptime":                    true,
+	"xenstats_vm_snapshot_oldest_age":         true,
+}
+
+func testConfig(hosts ...string) Config {
+	return Config{
+		Pools: []PoolConfig{{
+			Name:        "pool1",
+			Xenhost:     hosts[0],
+			Xenhosts:    hosts[1:],
+			Credentials: Credentials{Username: "root", Password: "secret"},
+			TLSConfig:   TLSConfig{InsecureSkipVerify: true},
+		}},
+	}
+}
+
+// scrape gathers the exporter and returns the exposition without the
+// volatile metrics
+func scrape(t *testing.T, e *Exporter) []byte {
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(e)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	var b bytes.Buffer
+	for _, family := range families {
+		if volatileMetrics[family.GetName()] {
+			continue
+		}
+		_, err := expfmt.MetricFamilyToText(&b, family)
+		if err != nil {
+			t.Fatalf("could not encode %s: %v", family.GetName(), err)
+		}
+	}
+	return b.Bytes()
+}
+
+func compareGolden(t *testing.T, name string, actual []byte) {
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		err := ioutil.WriteFile(golden, actual, 0644)
+		if err != nil {
+			t.Fatalf("could not update golden file: %v", err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("could not read golden file: %v", err)
+	}
+	if !bytes.Equal(normalizeExposition(t, expected), normalizeExposition(t, actual)) {
+		t.Errorf("exposition differs from %s, run go test -update to regenerate it\n\ngot:\n%s", golden, actual)
+	}
+}
+
+// normalizeExposition parses and encodes an exposition again, the number
+// formatting differs between versions of expfmt
+func normalizeExposition(t *testing.T, exposition []byte) []byte {
+	parser := expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(exposition))
+	if err != nil {
+		t.Fatalf("could not parse exposition: %v", err)
+	}
+	names := []string{}
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		_, err := expfmt.MetricFamilyToText(&b, families[name])
+		if err != nil {
+			t.Fatalf("could not encode %s: %v", name, err)
+		}
+	}
+	return b.Bytes()
+}
+
+func TestExporterGolden(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+
+	e := NewExporter(testConfig(mock.Address()))
+	defer e.Close()
+
+	compareGolden(t, "exporter", scrape(t, e))
+}
+
+func TestExporterReusesSession(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+
+	e := NewExporter(testConfig(mock.Address()))
+	scrape(t, e)
+	scrape(t, e)
+	if mock.Logins() != 1 {
+		t.Errorf("expected 1 login for 2 scrapes, got %d", mock.Logins())
+	}
+
+	e.Close()
+	if mock.Sessions() != 0 {
+		t.Errorf("expected the session to be logged out on close, %d left", mock.Sessions())
+	}
+}
+
+func TestExporterFollowsPoolMaster(t *testing.T) {
+	master := newMockXenAPI(t, "pool")
+	defer master.Close()
+	slave := newMockXenAPISlave(master)
+	defer slave.Close()
+
+	e := NewExporter(testConfig(slave.Address()))
+	defer e.Close()
+
+	output := scrape(t, e)
+	if !bytes.Contains(output, []byte(`xenstats_up{pool="pool1"} 1`)) {
+		t.Errorf("expected the pool to be up through the master, got:\n%s", output)
+	}
+	if master.Logins() != 1 {
+		t.Errorf("expected 1 login at the master, got %d", master.Logins())
+	}
+}
+
+func TestExporterPoolDown(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	address := mock.Address()
+	mock.Close()
+
+	e := NewExporter(testConfig(address))
+	defer e.Close()
+
+	output := scrape(t, e)
+	if !bytes.Contains(output, []byte(`xenstats_up{pool="pool1"} 0`)) {
+		t.Errorf("expected the pool to be down, got:\n%s", output)
+	}
+}
+
+func TestExporterPoolsConcurrently(t *testing.T) {
+	slow := newMockXenAPI(t, "pool")
+	defer slow.Close()
+	fast := newMockXenAPI(t, "pool")
+	defer fast.Close()
+	release := slow.Hold()
+
+	config := testConfig(slow.Address())
+	config.Pools = append(config.Pools, testConfig(fast.Address()).Pools[0])
+	config.Pools[1].Name = "pool2"
+	e := NewExporter(config)
+	defer e.Close()
+
+	// the second pool is scraped while the first one does not answer
+	concurrent := make(chan bool, 1)
+	go func() {
+		defer release()
+		deadline := time.Now().Add(10 * time.Second)
+		for fast.Logins() == 0 {
+			if time.Now().After(deadline) {
+				concurrent <- false
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		concurrent <- true
+	}()
+	output := scrape(t, e)
+	if !<-concurrent {
+		t.Errorf("expected the pools to be scraped at the same time")
+	}
+	for _, expected := range []string{`xenstats_up{pool="pool1"} 1`, `xenstats_up{pool="pool2"} 1`} {
+		if !bytes.Contains(output, []byte(expected)) {
+			t.Errorf("expected %s, got:\n%s", expected, output)
+		}
+	}
+}
+
+func TestProbeHandler(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+
+	config := Config{
+		Collectors: map[string]bool{"rrd": false},
+		Modules: map[string]Module{
+			"default": {
+				Credentials:    Credentials{Username: "root", Password: "secret"},
+				TLSConfig:      TLSConfig{InsecureSkipVerify: true},
+				AllowedTargets: regexp.QuoteMeta(mock.Address()),
+			},
+		},
+	}
+	probe := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		probeHandler(func() Config { return config })(w, httptest.NewRequest(http.MethodGet, "/probe?target="+url.QueryEscape(target), nil))
+		return w
+	}
+
+	if w := probe("evil.example.com"); w.Code != http.StatusForbidden {
+		t.Errorf("expected a target not allowed by the module to be rejected, got %d", w.Code)
+	}
+	if mock.Logins() != 0 {
+		t.Errorf("expected no login for a rejected target, got %d", mock.Logins())
+	}
+
+	w := probe(mock.Address())
+	output := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(output, "xenstats_up{pool=") {
+		t.Fatalf("expected the allowed target to be probed, got %d:\n%s", w.Code, output)
+	}
+	if strings.Contains(output, "xenstats_rrd_host_value") {
+		t.Errorf("expected the collectors of the config to apply to probes, got:\n%s", output)
+	}
+}
+
+func TestParseRRDDataSource(t *testing.T) {
+	tests := []struct {
+		ds     string
+		name   string
+		device string
+	}{
+		{"cpu0", "cpu", "0"},
+		{"vif_0_rx", "vif_rx", "0"},
+		{"pif_eth0_tx", "pif_tx", "eth0"},
+		{"sr_5d1c0d6e-0b7d-4c1c-8f0e-000000000001_read", "sr_read", "5d1c0d6e-0b7d-4c1c-8f0e-000000000001"},
+		{"memory_total_kib", "memory_total_kib", ""},
+	}
+	for _, test := range tests {
+		name, device := parseRRDDataSource(test.ds)
+		if name != test.name || device != test.device {
+			t.Errorf("parseRRDDataSource(%q) = %q, %q, expected %q, %q", test.ds, name, device, test.name, test.device)
+		}
+	}
+}
+
+func TestApiCallerStatsDuringLogin(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+	release := mock.Hold()
+	defer release()
+
+	caller, err := NewApiCaller(testConfig(mock.Address()).GetPools()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Logout()
+
+	go caller.GetXenAPIClient()
+	deadline := time.Now().Add(10 * time.Second)
+	for mock.Held() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the login did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the getters answer while the master does not
+	done := make(chan struct{})
+	go func() {
+		caller.Logins()
+		caller.SessionFailures()
+		caller.Master()
+		caller.CertificateExpiry()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the getters wait for the login")
+	}
+}
+
+func TestRPCCallsPerScrape(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+
+	caller, err := NewApiCaller(testConfig(mock.Address()).GetPools()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Logout()
+
+	// two scrapes sharing the session count their own calls only
+	first, err := NewXenstats("pool1", caller, newXenDescs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewXenstats("pool1", caller, newXenDescs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, class := range []string{"host", "VM"} {
+		if _, err := second.getAllRecords(class); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := first.getAllRecords("host"); err != nil {
+		t.Fatal(err)
+	}
+	// records fetched before are not fetched again
+	if _, err := first.getAllRecords("host"); err != nil {
+		t.Fatal(err)
+	}
+
+	if *first.calls != 1 || *second.calls != 2 {
+		t.Errorf("expected 1 and 2 calls, got %d and %d", *first.calls, *second.calls)
+	}
+}
+
+func TestRRDStateForgetsHosts(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+
+	caller, err := NewApiCaller(testConfig(mock.Address()).GetPools()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Logout()
+	stats, err := NewXenstats("pool1", caller, newXenDescs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := NewRRDState()
+	state.hosts["gone.fqdn.de"] = &rrdHostState{values: map[string]float64{}}
+	ch := make(chan prometheus.Metric)
+	go func() {
+		for range ch {
+		}
+	}()
+	err = stats.createRRDMetrics(ch, state)
+	close(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := state.hosts["gone.fqdn.de"]; ok {
+		t.Errorf("expected the state of a host which left the pool to be dropped")
+	}
+	if len(state.hosts) == 0 {
+		t.Errorf("expected the states of the hosts of the pool to be kept")
+	}
+}
+
+func TestExporterReload(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+
+	config := testConfig(mock.Address())
+	e := NewExporter(config)
+	defer e.Close()
+	scrape(t, e)
+
+	// an unchanged pool keeps its session
+	e.Reload(testConfig(mock.Address()))
+	scrape(t, e)
+	if mock.Logins() != 1 {
+		t.Errorf("expected the session to be kept, got %d logins", mock.Logins())
+	}
+
+	// a changed pool logs in again, the old session is logged out
+	changed := testConfig(mock.Address())
+	changed.Pools[0].Collectors = map[string]bool{"rrd": false}
+	e.Reload(changed)
+	scrape(t, e)
+	if mock.Logins() != 2 || mock.Sessions() != 1 {
+		t.Errorf("expected a new session, got %d logins and %d sessions", mock.Logins(), mock.Sessions())
+	}
+
+	// a removed pool is logged out and gone from the output
+	e.Reload(Config{})
+	output := scrape(t, e)
+	if mock.Sessions() != 0 {
+		t.Errorf("expected the removed pool to be logged out, %d sessions left", mock.Sessions())
+	}
+	if bytes.Contains(output, []byte(`xenstats_up{pool="pool1"}`)) {
+		t.Errorf("expected the removed pool to be gone, got:\n%s", output)
+	}
+}
+
+func TestExporterReloadRefreshInterval(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+
+	e := NewExporter(testConfig(mock.Address()))
+	config := testConfig(mock.Address())
+	config.RefreshInterval = time.Hour
+	e.Reload(config)
+
+	// the first refresh starts at once, its results show up when it is done
+	deadline := time.Now().Add(10 * time.Second)
+	for !bytes.Contains(scrape(t, e), []byte(`xenstats_up{pool="pool1"} 1`)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the background refresh did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	e.Reload(testConfig(mock.Address()))
+	e.Close()
+	if mock.Sessions() != 0 {
+		t.Errorf("expected all sessions to be logged out, %d left", mock.Sessions())
+	}
+}
+
+func TestValidatePools(t *testing.T) {
+	tests := []struct {
+		config Config
+		valid  bool
+	}{
+		{Config{Pools: []PoolConfig{{Name: "pool1", Xenhost: "xen1"}, {Name: "pool2", Xenhost: "xen5"}}}, true},
+		{Config{Pools: []PoolConfig{{Xenhosts: []string{"xen1", "xen2"}}}}, true},
+		{Config{Pools: []PoolConfig{{Name: "pool1", Xenhost: "xen1"}, {Name: "pool1", Xenhost: "xen5"}}}, false},
+		{Config{Pools: []PoolConfig{{Xenhost: "xen1"}, {Xenhost: "xen1"}}}, false},
+		{Config{Xenhost: "xen1", Pools: []PoolConfig{{Xenhost: "xen1"}}}, false},
+		{Config{Pools: []PoolConfig{{Name: "pool1"}}}, false},
+	}
+	for _, test := range tests {
+		err := test.config.validatePools()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: expected valid=%v, got %v", test.config, test.valid, err)
+		}
+	}
+}
+
+func TestExporterRefreshFailure(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	config := testConfig(mock.Address())
+	config.RefreshInterval = time.Hour
+	e := NewExporter(config)
+	defer e.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !bytes.Contains(scrape(t, e), []byte(`xenstats_up{pool="pool1"} 1`)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the background refresh did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the pool stops answering, its data is kept but it is down
+	mock.Close()
+	e.refresh()
+	output := scrape(t, e)
+	for _, expected := range []string{
+		`xenstats_up{pool="pool1"} 0`,
+		`xenstats_refresh_failures{pool="pool1"} 1`,
+		`xenstats_memory_total{hostname="xen1",pool="pool1",unit="bytes"}`,
+	} {
+		if !bytes.Contains(output, []byte(expected)) {
+			t.Errorf("expected %s, got:\n%s", expected, output)
+		}
+	}
+	if bytes.Contains(output, []byte(`xenstats_up{pool="pool1"} 1`)) {
+		t.Errorf("expected the stale up series to be dropped, got:\n%s", output)
+	}
+}
+
+func TestExporterRefreshDoesNotBlockScrapes(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+	config := testConfig(mock.Address())
+	config.RefreshInterval = time.Hour
+	e := NewExporter(config)
+	defer e.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !bytes.Contains(scrape(t, e), []byte(`xenstats_up{pool="pool1"} 1`)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the background refresh did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the session expires and the next login hangs
+	e.targetsMutex.Lock()
+	caller := e.targets["pool1"].caller
+	e.targetsMutex.Unlock()
+	c, err := caller.GetXenAPIClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller.invalidate(c)
+	release := mock.Hold()
+	refreshed := make(chan struct{})
+	go func() {
+		e.refresh()
+		close(refreshed)
+	}()
+	defer func() {
+		release()
+		<-refreshed
+	}()
+	for mock.Held() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the refresh did not log in")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	scraped := make(chan []byte, 1)
+	go func() {
+		scraped <- scrape(t, e)
+	}()
+	select {
+	case output := <-scraped:
+		if !bytes.Contains(output, []byte(`xenstats_memory_total{hostname="xen1",pool="pool1",unit="bytes"}`)) {
+			t.Errorf("expected the last results to be served, got:\n%s", output)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("the scrape waits for the login of the refresh")
+	}
+}
+
+func TestHostHealthPoolPatches(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+
+	// XenServer before 7.1 knows patches instead of updates
+	mock.mutex.Lock()
+	delete(mock.records, "pool_update")
+	mock.records["pool_patch"] = map[string]interface{}{
+		"OpaqueRef:patch1": map[string]interface{}{"name_label": "XS65E001"},
+		"OpaqueRef:patch2": map[string]interface{}{"name_label": "XS65E002"},
+	}
+	mock.records["host_patch"] = map[string]interface{}{
+		"OpaqueRef:host_patch1": map[string]interface{}{"pool_patch": "OpaqueRef:patch1", "applied": true},
+		"OpaqueRef:host_patch2": map[string]interface{}{"pool_patch": "OpaqueRef:patch2", "applied": false},
+	}
+	mock.records["host"]["OpaqueRef:host1"].(map[string]interface{})["patches"] = []interface{}{"OpaqueRef:host_patch1", "OpaqueRef:host_patch2"}
+	mock.mutex.Unlock()
+
+	e := NewExporter(testConfig(mock.Address()))
+	defer e.Close()
+
+	output := scrape(t, e)
+	for _, expected := range []string{
+		`xenstats_host_pending_updates{hostname="xen1",pool="pool1",unit="number"} 1`,
+		`xenstats_host_pending_updates{hostname="xen2",pool="pool1",unit="number"} 2`,
+	} {
+		if !bytes.Contains(output, []byte(expected)) {
+			t.Errorf("expected %s, got:\n%s", expected, output)
+		}
+	}
+	if bytes.Contains(output, []byte(`class="pool_update"`)) {
+		t.Errorf("expected the missing pool_update class not to be counted as error, got:\n%s", output)
+	}
+}
+
+func TestHostCPUWithoutCPUs(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+
+	mock.mutex.Lock()
+	mock.records["host"]["OpaqueRef:host2"].(map[string]interface{})["host_CPUs"] = []interface{}{}
+	mock.mutex.Unlock()
+
+	e := NewExporter(testConfig(mock.Address()))
+	defer e.Close()
+
+	output := scrape(t, e)
+	for _, expected := range []string{
+		`xenstats_vms_per_host{hostname="xen2",pool="pool1",unit="number"}`,
+		`xenstats_cpus_host_num{hostname="xen1",pool="pool1",unit="bytes"} 4`,
+		`xenstats_object_errors_total{class="host",collector="host_cpu",pool="pool1"} 1`,
+	} {
+		if !bytes.Contains(output, []byte(expected)) {
+			t.Errorf("expected %s, got:\n%s", expected, output)
+		}
+	}
+	if bytes.Contains(output, []byte(`xenstats_cpus_host_num{hostname="xen2"`)) {
+		t.Errorf("expected no cpu metrics of the host without cpus, got:\n%s", output)
+	}
+}
+
+func TestExporterReloadDuringRefresh(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+	release := mock.Hold()
+
+	config := testConfig(mock.Address())
+	config.RefreshInterval = time.Hour
+	e := NewExporter(config)
+	defer e.Close()
+
+	// wait for the first refresh to log in
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		e.targetsMutex.Lock()
+		started := len(e.targets) > 0
+		e.targetsMutex.Unlock()
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the background refresh did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the pool is removed while the refresh waits for the login
+	reloaded := make(chan struct{})
+	go func() {
+		e.Reload(Config{RefreshInterval: time.Hour})
+		close(reloaded)
+	}()
+	for {
+		if len(e.getConfig().GetPools()) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	release()
+	<-reloaded
+	e.stopRefresh()
+
+	e.targetsMutex.Lock()
+	targets := len(e.targets)
+	e.targetsMutex.Unlock()
+	e.resultsMutex.Lock()
+	results := len(e.results)
+	e.resultsMutex.Unlock()
+	if targets != 0 || results != 0 {
+		t.Errorf("expected the removed pool to stay removed, got %d targets and %d results", targets, results)
+	}
+	if mock.Sessions() != 0 {
+		t.Errorf("expected the removed pool to be logged out, %d sessions left", mock.Sessions())
+	}
+	output := scrape(t, e)
+	for _, series := range []string{`xenstats_up{pool="pool1"}`, `xenstats_refresh_failures{pool="pool1"}`} {
+		if bytes.Contains(output, []byte(series)) {
+			t.Errorf("expected the removed pool to be gone, got:\n%s", output)
+		}
+	}
+}
+
+func TestExporterReloadDropsChangedResults(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+
+	config := testConfig(mock.Address())
+	config.RefreshInterval = time.Hour
+	e := NewExporter(config)
+	defer e.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !bytes.Contains(scrape(t, e), []byte(`xenstats_up{pool="pool1"} 1`)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the background refresh did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	changed := testConfig(mock.Address())
+	changed.RefreshInterval = time.Hour
+	changed.Pools[0].Collectors = map[string]bool{"rrd": false}
+	e.Reload(changed)
+
+	if output := scrape(t, e); bytes.Contains(output, []byte("xenstats_rrd_host_value")) {
+		t.Errorf("expected the results of the old config to be dropped, got:\n%s", output)
+	}
+}
+
+func TestExporterReloadDuringHangingRefresh(t *testing.T) {
+	mock := newMockXenAPI(t, "pool")
+	defer mock.Close()
+	release := mock.Hold()
+
+	config := testConfig(mock.Address())
+	config.RefreshInterval = time.Hour
+	e := NewExporter(config)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for mock.Held() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the background refresh did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a new refresh interval does not wait for the refresh in progress
+	reloaded := make(chan struct{})
+	go func() {
+		changed := testConfig(mock.Address())
+		changed.RefreshInterval = 2 * time.Hour
+		e.Reload(changed)
+		close(reloaded)
+	}()
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the reload waits for the refresh")
+	}
+	release()
+	<-reloaded
+
+	e.Close()
+	if mock.Sessions() != 0 {
+		t.Errorf("expected all sessions to be logged out, %d left", mock.Sessions())
+	}
+}
+
+func TestExporterTargetAfterReload(t *testing.T) {
+	old := testConfig("xen1")
+	e := NewExporter(old)
+	defer e.Close()
+
+	changed := testConfig("xen1")
+	changed.Pools[0].Credentials.Password = "rotated"
+	e.Reload(changed)
+
+	if _, err := e.target(old.GetPools()[0]); err == nil {
+		t.Errorf("expected a scrape with the old config to be rejected")
+	}
+	if _, err := e.target(changed.GetPools()[0]); err != nil {
+		t.Errorf("unexpected error for the new config: %v", err)
+	}
+}
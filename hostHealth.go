@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	registerCollector("host_health", true, func() XenCollector { return collectorFunc(Xenstats.createHostHealthMetrics) })
+}
+
+// createHostHealthMetrics exports the state of the hosts which is looked at
+// first when a host misbehaves
+func (s Xenstats) createHostHealthMetrics(ch chan<- prometheus.Metric) error {
+	hosts, err := s.getAllRecords("host")
+	if err != nil {
+		return err
+	}
+	allHostMetrics, err := s.getAllRecords("host_metrics")
+	if err != nil {
+		return err
+	}
+	pools, err := s.getAllRecords("pool")
+	if err != nil {
+		return err
+	}
+	masters := map[string]bool{}
+	for _, pool := range pools {
+		masters[recordString(hosts[recordString(pool, "master")], "uuid")] = true
+	}
+
+	updates, applied, err := s.hostUpdates(hosts)
+	if err != nil && !isMethodUnknown(err) {
+		s.objectError("pool_update", "", err)
+	}
+	now := time.Now()
+
+	for _, ref := range sortedRefs(hosts) {
+		host := hosts[ref]
+		hostname := recordString(host, "name_label")
+		otherConfig := recordMap(host, "other_config")
+		softwareVersion := recordMap(host, "software_version")
+
+		s.gauge(ch, s.descs.hostEnabled, Btof(recordBool(host, "enabled")), hostname)
+		s.gauge(ch, s.descs.hostIsMaster, Btof(masters[recordString(host, "uuid")]), hostname)
+		s.gauge(ch, s.descs.hostMaintenanceMode, Btof(recordString(otherConfig, "MAINTENANCE_MODE") == "true"), hostname)
+		s.gauge(ch, s.descs.hostSoftwareInfo, 1, hostname, recordString(softwareVersion, "product_version"), recordString(softwareVersion, "build_number"))
+
+		if hostmetrics, ok := allHostMetrics[recordString(host, "metrics")]; ok {
+			s.gauge(ch, s.descs.hostLive, Btof(recordBool(hostmetrics, "live")), hostname)
+		}
+
+		// boot_time is a unix timestamp like 1507042186. A broken one only
+		// drops the uptime.
+		if bootTime := recordString(otherConfig, "boot_time"); bootTime != "" {
+			seconds, err := strconv.ParseFloat(bootTime, 64)
+			if err != nil {
+				s.objectError("host", hostname, fmt.Errorf("value conversation error of boot_time: %v", err))
+			} else {
+				uptime := now.Sub(time.Unix(int64(seconds), 0))
+				s.gauge(ch, s.descs.hostUptime, uptime.Seconds(), hostname)
+			}
+		}
+
+		if updates != nil {
+			pending := 0
+			for ref := range updates {
+				if !applied[recordString(host, "uuid")][ref] {
+					pending++
+				}
+			}
+			s.gauge(ch, s.descs.hostPendingUpdates, float64(pending), hostname)
+		}
+	}
+	return nil
+}
+
+// hostUpdates returns the updates of the pool and the updates applied by host
+// uuid. Pools before XenServer 7.1 have no pool_update class, their patches
+// are used instead.
+func (s Xenstats) hostUpdates(hosts map[string]ApiRecord) (updates map[string]ApiRecord, applied map[string]map[string]bool, err error) {
+	applied = map[string]map[string]bool{}
+
+	updates, err = s.getAllRecords("pool_update")
+	if err == nil {
+		for _, host := range hosts {
+			refs := map[string]bool{}
+			for _, ref := range recordRefs(host, "updates") {
+				refs[ref] = true
+			}
+			applied[recordString(host, "uuid")] = refs
+		}
+		return updates, applied, nil
+	}
+	if !isMethodUnknown(err) {
+		return nil, nil, err
+	}
+
+	updates, err = s.getAllRecords("pool_patch")
+	if err != nil {
+		return nil, nil, err
+	}
+	hostPatches, err := s.getAllRecords("host_patch")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, host := range hosts {
+		refs := map[string]bool{}
+		for _, ref := range recordRefs(host, "patches") {
+			if patch, ok := hostPatches[ref]; ok && recordBool(patch, "applied") {
+				refs[recordString(patch, "pool_patch")] = true
+			}
+		}
+		applied[recordString(host, "uuid")] = refs
+	}
+	return updates, applied, nil
+}
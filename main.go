@@ -6,8 +6,12 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/yaml.v2"
 )
 
@@ -16,6 +20,8 @@ var (
 	metricsPath   = flag.String("web.path", "/metrics", "Path under which to expose metrics.")
 	configFile    = flag.String("config.file", "config.yml", "Config file Path")
 	namespace     = flag.String("namespace", "xenstats", "Namespace for the xenexporter metrics.")
+	recordDir     = flag.String("record.dir", "", "Directory to record the xen api responses of every pool to.")
+	replayDir     = flag.String("replay.dir", "", "Directory to replay recorded xen api responses from instead of connecting to the pools.")
 )
 
 func readConfig() (config Config, err error) {
@@ -30,11 +36,108 @@ func readConfig() (config Config, err error) {
 	if err != nil {
 		return config, fmt.Errorf("could not unmarshal config: %v", err)
 	}
+
+	err = validateCollectors(config.Collectors)
+	if err == nil {
+		err = config.Credentials.validate()
+	}
+	if err == nil {
+		err = validateConnection(config.Scheme, config.TLSConfig)
+	}
+	if err == nil {
+		err = config.validatePools()
+	}
+	if err != nil {
+		return config, fmt.Errorf("invalid config: %v", err)
+	}
+	for _, pool := range config.Pools {
+		err = validateCollectors(pool.Collectors)
+		if err == nil {
+			err = pool.Credentials.validate()
+		}
+		if err == nil {
+			err = validateConnection(pool.Scheme, pool.TLSConfig)
+		}
+		if err != nil {
+			return config, fmt.Errorf("invalid config of pool %s: %v", pool.Name, err)
+		}
+	}
+	for name, module := range config.Modules {
+		err = validateCollectors(module.Collectors)
+		if err == nil {
+			err = module.Credentials.validate()
+		}
+		if err == nil {
+			err = validateConnection(module.Scheme, module.TLSConfig)
+		}
+		if err == nil {
+			_, err = module.allowedTargets()
+		}
+		if err != nil {
+			return config, fmt.Errorf("invalid config of module %s: %v", name, err)
+		}
+	}
 	return config, err
 }
 
+// probeHandler scrapes the pool given by the target parameter with the
+// credentials of the requested module of the active config. The collectors
+// and the host concurrency of the config apply to the probes as well.
+func probeHandler(getConfig func() Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := getConfig()
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "'target' parameter must be specified", http.StatusBadRequest)
+			return
+		}
+
+		moduleName := r.URL.Query().Get("module")
+		if moduleName == "" {
+			moduleName = "default"
+		}
+		module, ok := config.Modules[moduleName]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+			return
+		}
+		allowed, err := module.allowedTargets()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if allowed != nil && !allowed.MatchString(target) {
+			http.Error(w, fmt.Sprintf("Target %q is not allowed by module %q", target, moduleName), http.StatusForbidden)
+			return
+		}
+
+		exporter := NewExporter(Config{
+			Pools: []PoolConfig{{
+				Name:        target,
+				Xenhost:     target,
+				Credentials: module.Credentials,
+				Scheme:      module.Scheme,
+				TLSConfig:   module.TLSConfig,
+				Collectors:  module.Collectors,
+			}},
+			Collectors:      config.Collectors,
+			HostConcurrency: config.HostConcurrency,
+		})
+
+		defer exporter.Close()
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(exporter)
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
+
 func main() {
 	flag.Parse()
+	if *recordDir != "" && *replayDir != "" {
+		log.Printf("-record.dir and -replay.dir can not be used together")
+		return
+	}
 
 	config, err := readConfig()
 	if err != nil {
@@ -42,10 +145,27 @@ func main() {
 		return
 	}
 
-	prometheus.MustRegister(NewExporter(config))
+	exporter := NewExporter(config)
+	prometheus.MustRegister(exporter)
+
+	reloader := newReloader(exporter)
+	prometheus.MustRegister(reloader)
+	go reloader.watchSignals()
+
+	// log out of the xen sessions on shutdown, they would pile up on the pool master otherwise
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Printf("Shutting down")
+		exporter.Close()
+		os.Exit(0)
+	}()
 
 	log.Printf("Starting Server: %s", *listenAddress)
 	handler := prometheus.Handler()
+	http.Handle("/probe", probeHandler(exporter.getConfig))
+	http.Handle("/-/reload", reloader)
 	if *metricsPath == "" || *metricsPath == "/" {
 		http.Handle(*metricsPath, handler)
 	} else {
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// messageKey groups the messages of a pool
+type messageKey struct {
+	name     string
+	priority string
+	class    string
+}
+
+// messageCollector counts the messages raised by the pool since the
+// collector was created. Every message is counted once.
+type messageCollector struct {
+	sync.Mutex
+	start  time.Time
+	seen   map[string]bool
+	counts map[messageKey]int
+}
+
+func init() {
+	registerCollector("message", true, func() XenCollector {
+		return &messageCollector{
+			start:  time.Now(),
+			seen:   map[string]bool{},
+			counts: map[messageKey]int{},
+		}
+	})
+}
+
+// Update -
+func (c *messageCollector) Update(stats *Xenstats, ch chan<- prometheus.Metric) error {
+	c.Lock()
+	defer c.Unlock()
+
+	messages, err := stats.getAllRecords("message")
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	unacknowledged := map[messageKey]int{}
+	for ref, message := range messages {
+		timestamp, err := recordTime(message, "timestamp")
+		if err != nil {
+			stats.objectError("message", recordString(message, "name"), err)
+			continue
+		}
+		if timestamp.Before(c.start) {
+			continue
+		}
+
+		key := messageKey{
+			name:     recordString(message, "name"),
+			priority: recordString(message, "priority"),
+			class:    recordString(message, "cls"),
+		}
+		unacknowledged[key]++
+		if !c.seen[ref] {
+			c.counts[key]++
+			c.seen[ref] = true
+		}
+		seen[ref] = true
+	}
+	// dismissed messages are gone for good, they do not have to be remembered
+	c.seen = seen
+
+	for key, count := range c.counts {
+		stats.counter(ch, stats.descs.messages, float64(count), key.name, key.priority, key.class)
+		stats.gauge(ch, stats.descs.messagesUnacknowledged, float64(unacknowledged[key]), key.name, key.priority, key.class)
+	}
+	return nil
+}
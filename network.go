@@ -0,0 +1,123 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	registerCollector("network", true, func() XenCollector { return collectorFunc(Xenstats.createNetworkMetrics) })
+}
+
+func (s Xenstats) createNetworkMetrics(ch chan<- prometheus.Metric) error {
+	err := s.createPIFMetrics(ch)
+	if err != nil {
+		return err
+	}
+	return s.createVIFMetrics(ch)
+}
+
+// createPIFMetrics exports the physical interfaces of the hosts
+func (s Xenstats) createPIFMetrics(ch chan<- prometheus.Metric) error {
+	pifs, err := s.getAllRecords("PIF")
+	if err != nil {
+		return err
+	}
+	allPIFMetrics, err := s.getAllRecords("PIF_metrics")
+	if err != nil {
+		return err
+	}
+	networks, err := s.getAllRecords("network")
+	if err != nil {
+		return err
+	}
+	hosts, err := s.getAllRecords("host")
+	if err != nil {
+		return err
+	}
+	bonds, err := s.getAllRecords("Bond")
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range sortedRefs(pifs) {
+		pif := pifs[ref]
+		labels := []string{
+			recordString(hosts[recordString(pif, "host")], "name_label"),
+			recordString(pif, "device"),
+			recordString(networks[recordString(pif, "network")], "name_label"),
+		}
+
+		mtu, err := recordInt(pif, "MTU")
+		if err != nil {
+			s.objectError("PIF", labels[0]+"/"+labels[1], err)
+			continue
+		}
+		vlan, err := recordInt(pif, "VLAN")
+		if err != nil {
+			s.objectError("PIF", labels[0]+"/"+labels[1], err)
+			continue
+		}
+
+		s.gauge(ch, s.descs.pifInfo, 1, append(labels, recordString(pif, "MAC"))...)
+		s.gauge(ch, s.descs.pifMTU, float64(mtu), labels...)
+		s.gauge(ch, s.descs.pifVLAN, float64(vlan), labels...)
+		s.gauge(ch, s.descs.pifManagement, Btof(recordBool(pif, "management")), labels...)
+
+		if bond, ok := bonds[recordString(pif, "bond_slave_of")]; ok {
+			master := pifs[recordString(bond, "master")]
+			s.gauge(ch, s.descs.pifBondSlave, 1, append(labels, recordString(master, "device"))...)
+		}
+
+		// pifs which are not plugged have no metrics
+		pifMetrics, ok := allPIFMetrics[recordString(pif, "metrics")]
+		if !ok {
+			continue
+		}
+		speed, err := recordInt(pifMetrics, "speed")
+		if err != nil {
+			s.objectError("PIF_metrics", labels[0]+"/"+labels[1], err)
+			continue
+		}
+		s.gauge(ch, s.descs.pifCarrier, Btof(recordBool(pifMetrics, "carrier")), labels...)
+		s.gauge(ch, s.descs.pifSpeed, float64(speed), labels...)
+		s.gauge(ch, s.descs.pifDuplex, Btof(recordBool(pifMetrics, "duplex")), labels...)
+	}
+	return nil
+}
+
+// createVIFMetrics exports the virtual interfaces of the vms
+func (s Xenstats) createVIFMetrics(ch chan<- prometheus.Metric) error {
+	vifs, err := s.getAllRecords("VIF")
+	if err != nil {
+		return err
+	}
+	vms, err := s.getAllRecords("VM")
+	if err != nil {
+		return err
+	}
+	networks, err := s.getAllRecords("network")
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range sortedRefs(vifs) {
+		vif := vifs[ref]
+		vm, ok := vms[recordString(vif, "VM")]
+		if !ok {
+			// the vm has been destroyed in between the calls
+			continue
+		}
+		if recordBool(vm, "is_control_domain") || recordBool(vm, "is_a_template") || recordBool(vm, "is_a_snapshot") {
+			continue
+		}
+
+		s.gauge(ch, s.descs.vifAttached, Btof(recordBool(vif, "currently_attached")),
+			recordString(vm, "name_label"),
+			recordString(vm, "uuid"),
+			recordString(vif, "device"),
+			recordString(networks[recordString(vif, "network")], "name_label"),
+			recordString(vif, "MAC"),
+		)
+	}
+	return nil
+}
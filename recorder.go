@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordedSession replaces the session references in recordings
+const recordedSession = "OpaqueRef:recorded-session"
+
+// exchange is a request to the xen api and its response as saved in a
+// recording. Requests are sanitized, they hold no passwords or sessions.
+type exchange struct {
+	Host     string        `json:"host"`
+	Request  string        `json:"request"`
+	Status   int           `json:"status"`
+	Response string        `json:"response"`
+	Duration time.Duration `json:"duration"`
+}
+
+func (x exchange) key() string {
+	return x.Host + " " + x.Request
+}
+
+// recordingPath returns the recording of a pool in dir
+func recordingPath(dir string, pool string) string {
+	return filepath.Join(dir, invalidFileChars.ReplaceAllString(pool, "_")+".jsonl")
+}
+
+var invalidFileChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+var (
+	methodNameRegexp   = regexp.MustCompile(`<methodName>([^<]*)</methodName>`)
+	sessionValueRegexp = regexp.MustCompile(`<name>Value</name>\s*<value>(?:<string>)?([^<]+)`)
+)
+
+// sanitizeRequest returns the part of a request which is saved and matched in
+// recordings. The credentials of logins are dropped and the query of plain
+// http requests is ignored, it holds the session and the current time.
+func sanitizeRequest(req *http.Request, body []byte, sessions map[string]bool) string {
+	if req.Method != http.MethodPost {
+		return req.Method + " " + req.URL.Path
+	}
+	match := methodNameRegexp.FindSubmatch(body)
+	if match != nil && string(match[1]) == "session.login_with_password" {
+		return string(match[1])
+	}
+	return sanitizeSessions(string(body), sessions)
+}
+
+// requestName names a request in errors, i.e. the xen api method
+func requestName(req *http.Request, body []byte) string {
+	if match := methodNameRegexp.FindSubmatch(body); match != nil {
+		return string(match[1])
+	}
+	return req.Method + " " + req.URL.Path
+}
+
+func sanitizeSessions(s string, sessions map[string]bool) string {
+	for session := range sessions {
+		s = strings.Replace(s, session, recordedSession, -1)
+	}
+	return s
+}
+
+// recordMutex serializes the writes of all recorders, the callers of a pool
+// share the recording
+var recordMutex sync.Mutex
+
+// recorder saves the requests and responses passing the transport. redact
+// removes the password from them, xen api faults may repeat it.
+type recorder struct {
+	next   http.RoundTripper
+	path   string
+	redact func(string) string
+
+	mutex    sync.Mutex
+	sessions map[string]bool
+}
+
+func newRecorder(next http.RoundTripper, path string, redact func(string) string) *recorder {
+	return &recorder{
+		next:     next,
+		path:     path,
+		redact:   redact,
+		sessions: map[string]bool{},
+	}
+}
+
+// RoundTrip -
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	start := time.Now()
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	response, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(response))
+
+	r.mutex.Lock()
+	request := sanitizeRequest(req, body, r.sessions)
+	if request == "session.login_with_password" {
+		if match := sessionValueRegexp.FindSubmatch(response); match != nil {
+			r.sessions[string(match[1])] = true
+		}
+	}
+	x := exchange{
+		Host:     req.URL.Host,
+		Request:  r.redact(request),
+		Status:   resp.StatusCode,
+		Response: r.redact(sanitizeSessions(string(response), r.sessions)),
+		Duration: time.Since(start),
+	}
+	r.mutex.Unlock()
+
+	err = r.save(x)
+	if err != nil {
+		log.Printf("Could not record xen api response: %v", err)
+	}
+	return resp, nil
+}
+
+func (r *recorder) save(x exchange) error {
+	line, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+
+	recordMutex.Lock()
+	defer recordMutex.Unlock()
+
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// replayer answers requests from a recording without any network access.
+// Requests seen several times get the recorded responses in order, the last
+// one is repeated when they run out. Responses take as long as recorded, so
+// long polls do not spin.
+type replayer struct {
+	mutex     sync.Mutex
+	exchanges map[string][]exchange
+	next      map[string]int
+}
+
+func newReplayer(path string) (*replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read recording: %v", err)
+	}
+	defer f.Close()
+
+	r := &replayer{
+		exchanges: map[string][]exchange{},
+		next:      map[string]int{},
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		x := exchange{}
+		err := json.Unmarshal(scanner.Bytes(), &x)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse recording %s: %v", path, err)
+		}
+		r.exchanges[x.key()] = append(r.exchanges[x.key()], x)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read recording: %v", err)
+	}
+	return r, nil
+}
+
+// RoundTrip -
+func (r *replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	key := exchange{
+		Host:    req.URL.Host,
+		Request: sanitizeRequest(req, body, nil),
+	}.key()
+
+	r.mutex.Lock()
+	exchanges := r.exchanges[key]
+	if len(exchanges) == 0 {
+		r.mutex.Unlock()
+		return nil, fmt.Errorf("no recorded response for %s of %s", requestName(req, body), req.URL.Host)
+	}
+	i := r.next[key]
+	if i < len(exchanges)-1 {
+		r.next[key]++
+	}
+	x := exchanges[i]
+	r.mutex.Unlock()
+
+	select {
+	case <-time.After(x.Duration):
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", x.Status, http.StatusText(x.Status)),
+		StatusCode:    x.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/xml"}},
+		Body:          ioutil.NopCloser(strings.NewReader(x.Response)),
+		ContentLength: int64(len(x.Response)),
+		Request:       req,
+	}, nil
+}
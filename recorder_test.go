@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xenstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		*recordDir = ""
+		*replayDir = ""
+	}()
+
+	mock := newMockXenAPI(t, "pool")
+	config := testConfig(mock.Address())
+
+	*recordDir = dir
+	e := NewExporter(config)
+	recorded := scrape(t, e)
+	e.Close()
+	mock.Close()
+
+	recording, err := ioutil.ReadFile(recordingPath(dir, "pool1"))
+	if err != nil {
+		t.Fatalf("no recording written: %v", err)
+	}
+	for _, secret := range []string{"secret", "OpaqueRef:session-"} {
+		if bytes.Contains(recording, []byte(secret)) {
+			t.Errorf("recording contains %q", secret)
+		}
+	}
+
+	*recordDir = ""
+	*replayDir = dir
+	e = NewExporter(config)
+	defer e.Close()
+	replayed := scrape(t, e)
+
+	if !bytes.Equal(recorded, replayed) {
+		t.Errorf("replay differs from recording\n\nrecorded:\n%s\n\nreplayed:\n%s", recorded, replayed)
+	}
+
+	// the fault of a failed login repeats the password in the mock
+	failedDir := filepath.Join(dir, "failed")
+	err = os.Mkdir(failedDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock = newMockXenAPI(t, "pool")
+	defer mock.Close()
+	config = testConfig(mock.Address())
+	config.Pools[0].Credentials.Password = "wrong-password"
+
+	*replayDir = ""
+	*recordDir = failedDir
+	failed := NewExporter(config)
+	scrape(t, failed)
+	failed.Close()
+
+	recording, err = ioutil.ReadFile(recordingPath(failedDir, "pool1"))
+	if err != nil {
+		t.Fatalf("no recording written: %v", err)
+	}
+	if !bytes.Contains(recording, []byte("SESSION_AUTHENTICATION_FAILED")) {
+		t.Errorf("expected the failed login to be recorded, got:\n%s", recording)
+	}
+	if bytes.Contains(recording, []byte("wrong-password")) {
+		t.Errorf("recording contains the password:\n%s", recording)
+	}
+}
+
+func TestReplayWithoutRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xenstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = newReplayer(recordingPath(dir, "pool1"))
+	if err == nil {
+		t.Errorf("expected an error for a missing recording")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultStalenessIntervals bounds the age of the served results to this many
+// refresh intervals if no max staleness is configured
+const defaultStalenessIntervals = 5
+
+// poolResult holds the metrics of the last successful refresh of a pool
+type poolResult struct {
+	metrics     []prometheus.Metric
+	lastSuccess time.Time
+	failures    int
+}
+
+// startRefresh starts the background refresh if an interval is given. A
+// refresh loop started before is told to stop, but it is not waited for.
+// Its last refresh finishes in the background, only the results of pools
+// which did not change in between are kept.
+func (e *Exporter) startRefresh(interval time.Duration) {
+	e.loopMutex.Lock()
+	defer e.loopMutex.Unlock()
+
+	if e.stop != nil {
+		closeStop(e.stop)
+	}
+	e.stop = make(chan struct{})
+	if interval > 0 {
+		e.loops.Add(1)
+		go e.refreshLoop(interval, e.stop)
+	}
+}
+
+// stopRefresh stops the background refresh and waits for all refresh loops
+// to finish
+func (e *Exporter) stopRefresh() {
+	e.loopMutex.Lock()
+	closeStop(e.stop)
+	e.loopMutex.Unlock()
+
+	e.loops.Wait()
+}
+
+// closeStop closes a stop channel unless it is closed already
+func closeStop(stop chan struct{}) {
+	select {
+	case <-stop:
+		// already stopped
+	default:
+		close(stop)
+	}
+}
+
+// refreshLoop scrapes all pools every refresh interval until stop is closed
+func (e *Exporter) refreshLoop(interval time.Duration, stop <-chan struct{}) {
+	defer e.loops.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		e.refresh()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh scrapes all pools at the same time and stores their metrics. A pool
+// which did not answer keeps the metrics of its last successful refresh.
+func (e *Exporter) refresh() {
+	e.totalScrapes.Inc()
+	var wg sync.WaitGroup
+	for _, pool := range e.getConfig().GetPools() {
+		wg.Add(1)
+		go func(pool PoolConfig) {
+			defer wg.Done()
+			metrics, answered := e.refreshPool(pool)
+			e.storeResult(pool, metrics, answered)
+		}(pool)
+	}
+	wg.Wait()
+}
+
+// storeResult keeps the metrics of a refreshed pool
+func (e *Exporter) storeResult(pool PoolConfig, metrics []prometheus.Metric, answered bool) {
+	e.resultsMutex.Lock()
+	defer e.resultsMutex.Unlock()
+
+	// the pool was removed or changed by a reload during the refresh
+	current, ok := configuredPool(e.getConfig(), pool.Name)
+	if !ok {
+		delete(e.results, pool.Name)
+	}
+	if !ok || !reflect.DeepEqual(current, pool) {
+		return
+	}
+	result, ok := e.results[pool.Name]
+	if !ok {
+		result = &poolResult{}
+		e.results[pool.Name] = result
+	}
+	if answered {
+		result.metrics = metrics
+		result.lastSuccess = time.Now()
+		result.failures = 0
+	} else {
+		result.failures++
+		log.Printf("Refresh of pool %s failed %d times in a row", pool.Name, result.failures)
+	}
+}
+
+// refreshPool scrapes a single pool into a list of metrics
+func (e *Exporter) refreshPool(pool PoolConfig) ([]prometheus.Metric, bool) {
+	ch := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric)
+	go func() {
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		done <- metrics
+	}()
+
+	answered := e.collectPool(pool, ch)
+	close(ch)
+	return <-done, answered
+}
+
+// collectResults sends the stored metrics of the pools. A pool whose last
+// refresh failed is reported as down. Results older than the staleness bound
+// are dropped.
+func (e *Exporter) collectResults(ch chan<- prometheus.Metric, config Config) {
+	maxStaleness := config.MaxStaleness
+	if maxStaleness <= 0 {
+		maxStaleness = defaultStalenessIntervals * config.RefreshInterval
+	}
+
+	e.resultsMutex.Lock()
+	defer e.resultsMutex.Unlock()
+	for pool, result := range e.results {
+		ch <- prometheus.MustNewConstMetric(e.refreshFailuresDesc, prometheus.GaugeValue, float64(result.failures), pool)
+		if result.lastSuccess.IsZero() {
+			ch <- prometheus.MustNewConstMetric(e.upDesc, prometheus.GaugeValue, 0, pool)
+			continue
+		}
+
+		age := time.Since(result.lastSuccess)
+		ch <- prometheus.MustNewConstMetric(e.resultAgeDesc, prometheus.GaugeValue, age.Seconds(), pool)
+		if age > maxStaleness {
+			ch <- prometheus.MustNewConstMetric(e.upDesc, prometheus.GaugeValue, 0, pool)
+			continue
+		}
+		for _, metric := range result.metrics {
+			// the data of a pool which stopped answering is served, but the
+			// pool is down
+			if result.failures > 0 && metric.Desc() == e.upDesc {
+				continue
+			}
+			ch <- metric
+		}
+		if result.failures > 0 {
+			ch <- prometheus.MustNewConstMetric(e.upDesc, prometheus.GaugeValue, 0, pool)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reloader reads the config file again and applies it to the exporter. A
+// config which can not be read or is invalid is rejected, the active config
+// stays in place.
+type reloader struct {
+	mutex       sync.Mutex
+	exporter    *Exporter
+	success     prometheus.Gauge
+	successTime prometheus.Gauge
+}
+
+func newReloader(exporter *Exporter) *reloader {
+	r := &reloader{
+		exporter: exporter,
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: *namespace,
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last reload of the config succeeded",
+		}),
+		successTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: *namespace,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Time of the last successful reload of the config as unix timestamp",
+		}),
+	}
+	// the config read at startup counts as the first reload
+	r.success.Set(1)
+	r.successTime.SetToCurrentTime()
+	return r
+}
+
+// Describe -
+func (r *reloader) Describe(ch chan<- *prometheus.Desc) {
+	r.success.Describe(ch)
+	r.successTime.Describe(ch)
+}
+
+// Collect -
+func (r *reloader) Collect(ch chan<- prometheus.Metric) {
+	r.success.Collect(ch)
+	r.successTime.Collect(ch)
+}
+
+// Reload reads and validates the config file and replaces the config of the
+// exporter
+func (r *reloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	config, err := readConfig()
+	if err != nil {
+		r.success.Set(0)
+		return err
+	}
+	r.exporter.Reload(config)
+	r.success.Set(1)
+	r.successTime.SetToCurrentTime()
+	log.Printf("Reloaded config %s", *configFile)
+	return nil
+}
+
+// watchSignals reloads the config on SIGHUP
+func (r *reloader) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := r.Reload(); err != nil {
+			log.Printf("Could not reload config: %v", err)
+		}
+	}
+}
+
+// ServeHTTP reloads the config on a POST request
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.Reload(); err != nil {
+		log.Printf("Could not reload config: %v", err)
+		http.Error(w, fmt.Sprintf("Could not reload config: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestReloadHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xenstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(previous string) { *configFile = previous }(*configFile)
+	*configFile = filepath.Join(dir, "config.yml")
+
+	e := NewExporter(Config{})
+	defer e.Close()
+	r := newReloader(e)
+
+	reload := func(method string, config string) int {
+		err := ioutil.WriteFile(*configFile, []byte(config), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, "/-/reload", nil))
+		return w.Code
+	}
+	success := func() float64 {
+		metric := &dto.Metric{}
+		r.success.Write(metric)
+		return metric.GetGauge().GetValue()
+	}
+
+	if code := reload(http.MethodGet, "pools: []"); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be rejected, got %d", code)
+	}
+
+	if code := reload(http.MethodPost, "pools:\n  - name: pool1\n    xenhost: xen1\n"); code != http.StatusOK {
+		t.Errorf("expected the reload to succeed, got %d", code)
+	}
+	if pools := e.getConfig().GetPools(); len(pools) != 1 || pools[0].Name != "pool1" || success() != 1 {
+		t.Errorf("expected the new config to be active, got %+v", pools)
+	}
+
+	if code := reload(http.MethodPost, "collectors:\n  unknown: true\n"); code != http.StatusInternalServerError {
+		t.Errorf("expected the invalid config to be rejected, got %d", code)
+	}
+	if pools := e.getConfig().GetPools(); len(pools) != 1 || success() != 0 {
+		t.Errorf("expected the active config to be kept, got %+v", pools)
+	}
+
+	// connection settings which fail on every scrape are rejected as well
+	for _, config := range []string{
+		"pools:\n  - name: pool2\n    xenhost: xen2\n    scheme: ftp\n",
+		"pools:\n  - name: pool2\n    xenhost: xen2\n    tls_config:\n      ca_file: " + filepath.Join(dir, "missing.pem") + "\n",
+		"modules:\n  default:\n    tls_config:\n      cert_file: " + filepath.Join(dir, "missing.pem") + "\n",
+	} {
+		if code := reload(http.MethodPost, config); code != http.StatusInternalServerError {
+			t.Errorf("expected the config to be rejected, got %d:\n%s", code, config)
+		}
+		if pools := e.getConfig().GetPools(); len(pools) != 1 || pools[0].Name != "pool1" {
+			t.Errorf("expected the active config to be kept, got %+v", pools)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rrdLookback is the time range fetched from a host without previous updates
+const rrdLookback = 5 * time.Minute
+
+// rrdUpdates is the xml document returned by /rrd_updates
+type rrdUpdates struct {
+	Meta struct {
+		Start  int64    `xml:"start"`
+		End    int64    `xml:"end"`
+		Step   int64    `xml:"step"`
+		Legend []string `xml:"legend>entry"`
+	} `xml:"meta"`
+	Rows []struct {
+		Time   int64    `xml:"t"`
+		Values []string `xml:"v"`
+	} `xml:"data>row"`
+}
+
+// rrdHostState holds the latest rrd values of a host
+type rrdHostState struct {
+	lastUpdate int64
+	values     map[string]float64
+}
+
+// RRDState remembers the rrd values of the hosts of a pool between scrapes,
+// so only the updates since the last scrape have to be fetched
+type RRDState struct {
+	sync.Mutex
+	hosts map[string]*rrdHostState
+}
+
+// NewRRDState -
+func NewRRDState() *RRDState {
+	return &RRDState{
+		hosts: map[string]*rrdHostState{},
+	}
+}
+
+// rrdCollector exports the rrd values of the hosts and their vms
+type rrdCollector struct {
+	state *RRDState
+}
+
+func init() {
+	registerCollector("rrd", true, func() XenCollector {
+		return rrdCollector{state: NewRRDState()}
+	})
+}
+
+// Update -
+func (c rrdCollector) Update(stats *Xenstats, ch chan<- prometheus.Metric) error {
+	return stats.createRRDMetrics(ch, c.state)
+}
+
+// rrdDataSourcePatterns split device names off the data source names
+var rrdDataSourcePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^(?P<prefix>cpu)(?P<device>\d+)$`),
+	regexp.MustCompile(`^(?P<prefix>vif|vbd|pif)_(?P<device>[^_]+)_(?P<suffix>.+)$`),
+	regexp.MustCompile(`^(?P<prefix>sr)_(?P<device>[0-9a-f-]{36})_(?P<suffix>.+)$`),
+	regexp.MustCompile(`^(?P<prefix>.+)_(?P<device>[0-9a-f]{8})$`),
+}
+
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// parseRRDDataSource splits a data source like vif_0_rx into the metric name
+// vif_rx and the device 0
+func parseRRDDataSource(ds string) (name string, device string) {
+	name = ds
+	for _, re := range rrdDataSourcePatterns {
+		match := re.FindStringSubmatch(ds)
+		if match == nil {
+			continue
+		}
+		parts := []string{}
+		for i, group := range re.SubexpNames() {
+			switch group {
+			case "prefix", "suffix":
+				parts = append(parts, match[i])
+			case "device":
+				device = match[i]
+			}
+		}
+		name = strings.Join(parts, "_")
+		break
+	}
+	return strings.ToLower(invalidMetricChars.ReplaceAllString(name, "_")), device
+}
+
+// parseRRDUpdates returns the newest values of a rrd_updates response by legend entry
+func parseRRDUpdates(body []byte) (updates rrdUpdates, values map[string]float64, err error) {
+	err = xml.Unmarshal(body, &updates)
+	if err != nil {
+		return updates, values, fmt.Errorf("could not parse rrd updates: %v", err)
+	}
+	if len(updates.Rows) == 0 {
+		return updates, values, nil
+	}
+
+	latest := updates.Rows[0]
+	for _, row := range updates.Rows {
+		if row.Time > latest.Time {
+			latest = row
+		}
+	}
+	if len(latest.Values) != len(updates.Meta.Legend) {
+		return updates, values, fmt.Errorf("rrd updates row has %d values for %d legend entries", len(latest.Values), len(updates.Meta.Legend))
+	}
+
+	values = map[string]float64{}
+	for i, entry := range updates.Meta.Legend {
+		value, err := strconv.ParseFloat(latest.Values[i], 64)
+		if err != nil {
+			return updates, nil, fmt.Errorf("value conversation error of %s: %v", entry, err)
+		}
+		values[entry] = value
+	}
+	return updates, values, nil
+}
+
+// updateRRDHost fetches the rrd updates of a host since its last update
+func (s Xenstats) updateRRDHost(host *rrdHostState, address string) error {
+	query := url.Values{}
+	query.Set("start", strconv.FormatInt(host.lastUpdate, 10))
+	query.Set("cf", "AVERAGE")
+	query.Set("host", "true")
+	body, err := s.xend.GetHTTP(address, "/rrd_updates", query)
+	if err != nil {
+		return err
+	}
+
+	updates, values, err := parseRRDUpdates(body)
+	if err != nil {
+		return err
+	}
+	// hosts without new rows keep their last values
+	if values != nil {
+		host.values = values
+	}
+	if updates.Meta.End > host.lastUpdate {
+		host.lastUpdate = updates.Meta.End
+	}
+	return nil
+}
+
+func (s Xenstats) createRRDMetrics(ch chan<- prometheus.Metric, state *RRDState) error {
+	state.Lock()
+	defer state.Unlock()
+
+	hosts, err := s.getAllRecords("host")
+	if err != nil {
+		return err
+	}
+
+	// the states are created up front, so the hosts can be updated
+	// concurrently. Hosts which left the pool or changed their address are
+	// forgotten.
+	addresses := map[string]bool{}
+	for _, host := range hosts {
+		address := recordString(host, "address")
+		addresses[address] = true
+		if _, ok := state.hosts[address]; !ok {
+			state.hosts[address] = &rrdHostState{
+				lastUpdate: time.Now().Add(-rrdLookback).Unix(),
+				values:     map[string]float64{},
+			}
+		}
+	}
+	for address := range state.hosts {
+		if !addresses[address] {
+			delete(state.hosts, address)
+		}
+	}
+
+	s.forEachHost(ch, hosts, func(host ApiRecord) ([]prometheus.Metric, error) {
+		hostname := recordString(host, "name_label")
+		address := recordString(host, "address")
+		hostState := state.hosts[address]
+		err := s.updateRRDHost(hostState, address)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch rrd updates: %v", err)
+		}
+
+		// different data sources may end up with the same labels, the first
+		// legend entry in sorted order wins
+		entries := []string{}
+		for entry := range hostState.values {
+			entries = append(entries, entry)
+		}
+		sort.Strings(entries)
+
+		metrics := []prometheus.Metric{}
+		seen := map[string]bool{}
+		for _, entry := range entries {
+			value := hostState.values[entry]
+			// legend entries look like AVERAGE:vm:<uuid>:vif_0_rx
+			fields := strings.SplitN(entry, ":", 4)
+			if len(fields) != 4 || math.IsNaN(value) {
+				continue
+			}
+			name, device := parseRRDDataSource(fields[3])
+			key := strings.Join([]string{fields[1], fields[2], name, device}, ":")
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			switch fields[1] {
+			case "host":
+				metrics = append(metrics, s.newGauge(s.descs.rrdHost, value, hostname, name, device))
+			case "vm":
+				metrics = append(metrics, s.newGauge(s.descs.rrdVM, value, hostname, fields[2], name, device))
+			}
+		}
+		return metrics, nil
+	})
+	return nil
+}
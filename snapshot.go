@@ -0,0 +1,86 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	registerCollector("snapshot", true, func() XenCollector { return collectorFunc(Xenstats.createSnapshotMetrics) })
+}
+
+// createSnapshotMetrics exports the number, age and size of the snapshots of
+// the vms
+func (s Xenstats) createSnapshotMetrics(ch chan<- prometheus.Metric) error {
+	vms, err := s.getAllRecords("VM")
+	if err != nil {
+		return err
+	}
+	vbds, err := s.getAllRecords("VBD")
+	if err != nil {
+		return err
+	}
+	vdis, err := s.getAllRecords("VDI")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	for _, ref := range sortedRefs(vms) {
+		vm := vms[ref]
+		if recordBool(vm, "is_control_domain") || recordBool(vm, "is_a_template") || recordBool(vm, "is_a_snapshot") {
+			continue
+		}
+		vmName := recordString(vm, "name_label")
+		vmUUID := recordString(vm, "uuid")
+
+		count, size, oldest, err := snapshotStats(vm, vms, vbds, vdis)
+		if err != nil {
+			s.objectError("VM", vmName, err)
+			continue
+		}
+
+		s.gauge(ch, s.descs.vmSnapshots, float64(count), vmName, vmUUID)
+		s.gauge(ch, s.descs.vmSnapshotSize, float64(size), vmName, vmUUID)
+		if count > 0 {
+			s.gauge(ch, s.descs.vmSnapshotOldestAge, now.Sub(oldest).Seconds(), vmName, vmUUID)
+		}
+	}
+	return nil
+}
+
+// snapshotStats returns the number, the size and the time of the oldest of the
+// snapshots of a vm
+func snapshotStats(vm ApiRecord, vms, vbds, vdis map[string]ApiRecord) (count int, size int64, oldest time.Time, err error) {
+	for _, snapshotRef := range recordRefs(vm, "snapshots") {
+		snapshot, ok := vms[snapshotRef]
+		if !ok {
+			// the snapshot has been deleted in between the calls
+			continue
+		}
+		count++
+
+		snapshotTime, err := recordTime(snapshot, "snapshot_time")
+		if err != nil {
+			return count, size, oldest, err
+		}
+		if oldest.IsZero() || snapshotTime.Before(oldest) {
+			oldest = snapshotTime
+		}
+
+		for _, vbdRef := range recordRefs(snapshot, "VBDs") {
+			vdi, ok := vdis[recordString(vbds[vbdRef], "VDI")]
+			if !ok {
+				// empty cd drives have no vdi
+				continue
+			}
+			utilisation, err := recordInt(vdi, "physical_utilisation")
+			if err != nil {
+				return count, size, oldest, err
+			}
+			size += utilisation
+		}
+	}
+	return count, size, oldest, nil
+}
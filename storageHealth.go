@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// srOperations are always exported, so a disallowed operation shows up as 0
+var srOperations = []string{"scan", "destroy", "forget", "plug", "unplug", "update", "vdi_create", "vdi_destroy", "vdi_resize", "vdi_clone", "vdi_snapshot"}
+
+// multipathRegexp parses the path counts of a lun like [1, 2]
+var multipathRegexp = regexp.MustCompile(`^\[\s*(\d+)\s*,\s*(\d+)\s*\]$`)
+
+// parseMultipath returns the active and total paths of a mpath-<scsi id> entry
+// of the other_config of a PBD
+func parseMultipath(value string) (active int64, total int64, err error) {
+	match := multipathRegexp.FindStringSubmatch(value)
+	if match == nil {
+		return 0, 0, fmt.Errorf("value conversation error of multipath paths: %q", value)
+	}
+	active, _ = strconv.ParseInt(match[1], 10, 64)
+	total, _ = strconv.ParseInt(match[2], 10, 64)
+	return active, total, nil
+}
+
+// createStorageHealthMetrics exports the type, the PBDs and the allowed
+// operations of a storage
+func (s Xenstats) createStorageHealthMetrics(ch chan<- prometheus.Metric, storage ApiRecord, pbds map[string]ApiRecord, hosts map[string]ApiRecord) {
+	name := recordString(storage, "name_label")
+	uuid := recordString(storage, "uuid")
+
+	s.gauge(ch, s.descs.storageInfo, 1, name, uuid, recordString(storage, "type"), strconv.FormatBool(recordBool(storage, "shared")))
+
+	allowed := map[string]bool{}
+	for _, operation := range recordRefs(storage, "allowed_operations") {
+		allowed[operation] = true
+	}
+	operations := append([]string{}, srOperations...)
+	for operation := range allowed {
+		if !stringInSlice(operation, srOperations) {
+			operations = append(operations, operation)
+		}
+	}
+	for _, operation := range operations {
+		s.gauge(ch, s.descs.storageAllowedOperation, Btof(allowed[operation]), name, uuid, operation)
+	}
+
+	for _, pbdRef := range recordRefs(storage, "PBDs") {
+		pbd, ok := pbds[pbdRef]
+		if !ok {
+			// the pbd has been destroyed in between the calls
+			continue
+		}
+		hostname := recordString(hosts[recordString(pbd, "host")], "name_label")
+		s.gauge(ch, s.descs.storagePBDAttached, Btof(recordBool(pbd, "currently_attached")), name, uuid, hostname)
+
+		otherConfig := recordMap(pbd, "other_config")
+		keys := []string{}
+		for key := range otherConfig {
+			if strings.HasPrefix(key, "mpath-") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			active, total, err := parseMultipath(recordString(otherConfig, key))
+			if err != nil {
+				s.objectError("PBD", name+"/"+hostname, err)
+				continue
+			}
+			scsiID := strings.TrimPrefix(key, "mpath-")
+			s.gauge(ch, s.descs.storageMultipathActive, float64(active), name, uuid, hostname, scsiID)
+			s.gauge(ch, s.descs.storageMultipathTotal, float64(total), name, uuid, hostname, scsiID)
+		}
+	}
+}
+
+func stringInSlice(value string, list []string) bool {
+	for _, element := range list {
+		if element == value {
+			return true
+		}
+	}
+	return false
+}
@@ -3,34 +3,52 @@ package main
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	xsclient "github.com/xenserver/go-xenserver-client"
 )
 
 // Xenstats -
 type Xenstats struct {
-	xend      *ApiCaller
-	xenclient *xsclient.XenAPIClient
+	pool    string
+	xend    *ApiCaller
+	descs   *xenDescs
+	cache   *EventCache
+	records map[string]map[string]ApiRecord
+	// calls counts the xen api calls of this scrape, scrapes running at the
+	// same time share the ApiCaller but not the count
+	calls *int64
+
+	// hostConcurrency limits the hosts fetched from at the same time
+	hostConcurrency int
+	// objectErrors counts the objects skipped by collector
+	objectErrors *prometheus.CounterVec
+	collector    string
 }
 
-// NewXenstats -
-func NewXenstats(config Config) *Xenstats {
+// NewXenstats creates the stats of a single scrape. The session of the
+// ApiCaller is reused, a login is only done if there is no session yet. The
+// cache is optional, records it holds are not fetched from the xen api.
+func NewXenstats(pool string, xend *ApiCaller, descs *xenDescs, cache *EventCache) (*Xenstats, error) {
 	p := new(Xenstats)
 
-	xend := NewApiCaller(config.Xenhost, config.Credentials.Username, config.Credentials.Password)
-
-	// Need Login first if it is a fresh session
-	xenclient, err := xend.GetXenAPIClient()
+	_, err := xend.GetXenAPIClient()
 	if err != nil {
-		log.Printf("service.time call error: %v", err)
+		return nil, fmt.Errorf("XEN Api Error: %v", err)
 	}
 
-	p.xenclient = xenclient
+	p.pool = pool
 	p.xend = xend
+	p.descs = descs
+	p.cache = cache
+	p.records = map[string]map[string]ApiRecord{}
+	p.calls = new(int64)
 
-	return p
+	return p, nil
 }
 
 // GetApiCaller -
@@ -38,189 +56,325 @@ func (s Xenstats) GetApiCaller() *ApiCaller {
 	return s.xend
 }
 
-// CloseApi -
-func (s Xenstats) CloseApi() error {
-	return s.xenclient.RPC.Close()
+// xenDescs holds the descriptions of all metrics read from the xen api. They
+// are created once, every metric carries the pool label first.
+type xenDescs struct {
+	memoryTotal *prometheus.Desc
+	memoryFree  *prometheus.Desc
+
+	hostEnabled         *prometheus.Desc
+	hostLive            *prometheus.Desc
+	hostUptime          *prometheus.Desc
+	hostSoftwareInfo    *prometheus.Desc
+	hostPendingUpdates  *prometheus.Desc
+	hostIsMaster        *prometheus.Desc
+	hostMaintenanceMode *prometheus.Desc
+
+	storageVirtualAllocation   *prometheus.Desc
+	storagePhysicalUtilisation *prometheus.Desc
+	storagePhysicalSize        *prometheus.Desc
+	storageInfo                *prometheus.Desc
+	storagePBDAttached         *prometheus.Desc
+	storageMultipathActive     *prometheus.Desc
+	storageMultipathTotal      *prometheus.Desc
+	storageAllowedOperation    *prometheus.Desc
+
+	poolHAEnabled            *prometheus.Desc
+	haHostFailuresToTolerate *prometheus.Desc
+	haAllowOvercommit        *prometheus.Desc
+	haOvercommitted          *prometheus.Desc
+	wlbEnabled               *prometheus.Desc
+
+	vmsPerHost   *prometheus.Desc
+	cpusHostNum  *prometheus.Desc
+	cpusHostUtil *prometheus.Desc
+	cpusUsed     *prometheus.Desc
+	cpusFree     *prometheus.Desc
+
+	vmPowerState      *prometheus.Desc
+	vmMemoryTarget    *prometheus.Desc
+	vmMemoryActual    *prometheus.Desc
+	vmMemoryStaticMax *prometheus.Desc
+	vmVCPUs           *prometheus.Desc
+	vmStartTime       *prometheus.Desc
+	vmResidentHost    *prometheus.Desc
+	vmOSInfo          *prometheus.Desc
+
+	pifInfo       *prometheus.Desc
+	pifCarrier    *prometheus.Desc
+	pifSpeed      *prometheus.Desc
+	pifDuplex     *prometheus.Desc
+	pifMTU        *prometheus.Desc
+	pifVLAN       *prometheus.Desc
+	pifManagement *prometheus.Desc
+	pifBondSlave  *prometheus.Desc
+	vifAttached   *prometheus.Desc
+
+	vdiVirtualSize         *prometheus.Desc
+	vdiPhysicalUtilisation *prometheus.Desc
+	vdiSharable            *prometheus.Desc
+	vdiReadOnly            *prometheus.Desc
+	vdiIsSnapshot          *prometheus.Desc
+	vdiVBDs                *prometheus.Desc
+	vbdAttached            *prometheus.Desc
+
+	vmSnapshots         *prometheus.Desc
+	vmSnapshotOldestAge *prometheus.Desc
+	vmSnapshotSize      *prometheus.Desc
+
+	messages               *prometheus.Desc
+	messagesUnacknowledged *prometheus.Desc
+
+	rrdHost *prometheus.Desc
+	rrdVM   *prometheus.Desc
+
+	rpcCalls *prometheus.Desc
 }
 
-func (s Xenstats) createHostTotalMemMetric(hostmetrics string, hostname string) (metric *prometheus.GaugeVec, err error) {
-	memoryTotal, err := s.xend.GetSpecificValue("host_metrics.get_memory_total", hostmetrics)
-	if err != nil {
-		return metric, fmt.Errorf("XEN Api Error: %v", err)
-	}
-	memTotalInt, err := strconv.ParseInt(memoryTotal.(string), 10, 64)
-	if err != nil {
-		return metric, fmt.Errorf("could not parse memoryTotal: %v", err)
+// newDesc creates the description of a pool metric, unit is added as const
+// label if it is set
+func newDesc(name, help, unit string, labels ...string) *prometheus.Desc {
+	var constLabels prometheus.Labels
+	if unit != "" {
+		constLabels = prometheus.Labels{"unit": unit}
 	}
-
-	metric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: *namespace,
-		Name:      "memory_total",
-		Help:      "Total memory of the xen host",
-		ConstLabels: map[string]string{
-			"unit": "bytes",
-		},
-	}, []string{"hostname"})
-	labels := prometheus.Labels{"hostname": hostname}
-	metric.With(labels).Set(float64(memTotalInt))
-
-	return metric, err
+	return prometheus.NewDesc(
+		prometheus.BuildFQName(*namespace, "", name),
+		help,
+		append([]string{"pool"}, labels...),
+		constLabels,
+	)
 }
 
-func (s Xenstats) createHostFreeMemMetric(hostmetrics string, hostname string) (metric *prometheus.GaugeVec, err error) {
-	memoryTotal, err := s.xend.GetSpecificValue("host_metrics.get_memory_free", hostmetrics)
-	if err != nil {
-		return metric, fmt.Errorf("XEN Api Error: %v", err)
-	}
-	memTotalInt, err := strconv.ParseInt(memoryTotal.(string), 10, 64)
-	if err != nil {
-		return metric, fmt.Errorf("value conversation error: %v", err)
+func newXenDescs() *xenDescs {
+	storageLabels := []string{"label", "uuid", "default_storage"}
+	vmLabels := []string{"vm_name", "vm_uuid"}
+	pifLabels := []string{"hostname", "device", "network"}
+	messageLabels := []string{"name", "priority", "class"}
+	vdiLabels := []string{"sr_name", "sr_uuid", "vdi_name", "vdi_uuid", "vm_name", "vm_uuid"}
+
+	return &xenDescs{
+		memoryTotal: newDesc("memory_total", "Total memory of the xen host", "bytes", "hostname"),
+		memoryFree:  newDesc("memory_free", "Total memory of the xen host", "bytes", "hostname"),
+
+		hostEnabled:         newDesc("host_enabled", "true if the host is enabled, false otherwise", "bool", "hostname"),
+		hostLive:            newDesc("host_live", "true if the host is live, false otherwise", "bool", "hostname"),
+		hostUptime:          newDesc("host_uptime", "Time since the host booted", "seconds", "hostname"),
+		hostSoftwareInfo:    newDesc("host_software_info", "Software version of the host", "bool", "hostname", "product_version", "build_number"),
+		hostPendingUpdates:  newDesc("host_pending_updates", "Number of updates of the pool which are not applied to the host", "number", "hostname"),
+		hostIsMaster:        newDesc("host_is_master", "true if the host is the pool master, false otherwise", "bool", "hostname"),
+		hostMaintenanceMode: newDesc("host_maintenance_mode", "true if the host is in maintenance mode, false otherwise", "bool", "hostname"),
+
+		storageVirtualAllocation:   newDesc("storage_virtual_allocation", "Memory used by virtual instantances", "bytes", storageLabels...),
+		storagePhysicalUtilisation: newDesc("storage_physical_utilisation", "Persistent data physical utilization", "bytes", storageLabels...),
+		storagePhysicalSize:        newDesc("storage_physical_size", "Persistent data physical size", "bytes", storageLabels...),
+		storageInfo:                newDesc("storage_info", "Type of the storage and whether it is shared by the hosts", "bool", "label", "uuid", "type", "shared"),
+		storagePBDAttached:         newDesc("storage_pbd_attached", "true if the storage is plugged on the host, false otherwise", "bool", "label", "uuid", "hostname"),
+		storageMultipathActive:     newDesc("storage_multipath_active", "Number of active paths to the lun of the storage on the host", "number", "label", "uuid", "hostname", "scsi_id"),
+		storageMultipathTotal:      newDesc("storage_multipath_total", "Number of paths to the lun of the storage on the host", "number", "label", "uuid", "hostname", "scsi_id"),
+		storageAllowedOperation:    newDesc("storage_allowed_operation", "true if the operation is currently allowed on the storage, false otherwise", "bool", "label", "uuid", "operation"),
+
+		poolHAEnabled:            newDesc("pool_ha_enabled", "true if HA is enabled on the pool, false otherwise", "bool", "pool_name"),
+		haHostFailuresToTolerate: newDesc("ha_host_failures_to_tolerate", "Number of host failures to tolerate before the Pool is declared to be overcommitted", "int", "pool_name"),
+		haAllowOvercommit:        newDesc("ha_allow_overcommit", "If set to false then operations which would cause the Pool to become overcommitted will be blocked.", "bool", "pool_name"),
+		haOvercommitted:          newDesc("ha_overcommitted", "True if the Pool is considered to be overcommitted i.e. if there exist insufficient physical resources to tolerate the configured number of host failures", "bool", "pool_name"),
+		wlbEnabled:               newDesc("wlb_enabled", "true if workload balancing is enabled on the pool, false otherwise", "bool", "pool_name"),
+
+		vmsPerHost:   newDesc("vms_per_host", "Number of vm´s on the xenhost", "number", "hostname"),
+		cpusHostNum:  newDesc("cpus_host_num", "Number of cpu cores on the xenhost", "bytes", "hostname"),
+		cpusHostUtil: newDesc("cpus_host_util", "Used cpu cores on the xenhost in percentage", "percentage", "hostname"),
+		cpusUsed:     newDesc("cpus_used", "Used cpu cores on the xenhost", "number", "hostname"),
+		cpusFree:     newDesc("cpus_free", "Free cpu cores on the xenhost", "number", "hostname"),
+
+		vmPowerState:      newDesc("vm_power_state", "Power state of the vm, 1 for the current state", "bool", append(vmLabels, "power_state")...),
+		vmMemoryTarget:    newDesc("vm_memory_target", "Memory the vm is targeted to use", "bytes", vmLabels...),
+		vmMemoryActual:    newDesc("vm_memory_actual", "Memory actually used by the vm", "bytes", vmLabels...),
+		vmMemoryStaticMax: newDesc("vm_memory_static_max", "Statically-set maximum memory of the vm", "bytes", vmLabels...),
+		vmVCPUs:           newDesc("vm_vcpus", "Number of vcpus of the vm", "number", vmLabels...),
+		vmStartTime:       newDesc("vm_start_time", "Time the vm was started as unix timestamp", "seconds", vmLabels...),
+		vmResidentHost:    newDesc("vm_resident_host", "Host the vm is running on", "bool", append(vmLabels, "hostname")...),
+		vmOSInfo:          newDesc("vm_os_info", "Operating system of the vm as reported by the guest tools", "bool", append(vmLabels, "os_name", "os_distro", "os_major", "os_minor")...),
+
+		pifInfo:       newDesc("pif_info", "Physical interface of the xen host", "bool", append(pifLabels, "mac")...),
+		pifCarrier:    newDesc("pif_carrier", "true if the physical interface has a carrier, false otherwise", "bool", pifLabels...),
+		pifSpeed:      newDesc("pif_speed", "Link speed of the physical interface", "mbit", pifLabels...),
+		pifDuplex:     newDesc("pif_duplex", "true if the physical interface runs in full duplex, false otherwise", "bool", pifLabels...),
+		pifMTU:        newDesc("pif_mtu", "MTU of the physical interface", "bytes", pifLabels...),
+		pifVLAN:       newDesc("pif_vlan", "VLAN tag of the physical interface, -1 if it is untagged", "number", pifLabels...),
+		pifManagement: newDesc("pif_management", "true if the xen api is served on the physical interface, false otherwise", "bool", pifLabels...),
+		pifBondSlave:  newDesc("pif_bond_slave", "Bond the physical interface is a member of", "bool", append(pifLabels, "bond")...),
+		vifAttached:   newDesc("vif_attached", "true if the virtual interface is attached to the vm, false otherwise", "bool", append(vmLabels, "device", "network", "mac")...),
+
+		vdiVirtualSize:         newDesc("vdi_virtual_size", "Size of the virtual disk as seen by the vm", "bytes", vdiLabels...),
+		vdiPhysicalUtilisation: newDesc("vdi_physical_utilisation", "Space the virtual disk uses on the storage", "bytes", vdiLabels...),
+		vdiSharable:            newDesc("vdi_sharable", "true if the virtual disk can be attached to several vms, false otherwise", "bool", vdiLabels...),
+		vdiReadOnly:            newDesc("vdi_read_only", "true if the virtual disk is read only, false otherwise", "bool", vdiLabels...),
+		vdiIsSnapshot:          newDesc("vdi_is_snapshot", "true if the virtual disk is a snapshot, false otherwise", "bool", vdiLabels...),
+		vdiVBDs:                newDesc("vdi_vbds", "Number of block devices the virtual disk is plugged into, 0 for orphaned disks", "number", vdiLabels...),
+		vbdAttached:            newDesc("vbd_attached", "true if the block device of the virtual disk is attached to the vm, false otherwise", "bool", append(vdiLabels, "device")...),
+
+		vmSnapshots:         newDesc("vm_snapshots", "Number of snapshots of the vm", "number", vmLabels...),
+		vmSnapshotOldestAge: newDesc("vm_snapshot_oldest_age", "Age of the oldest snapshot of the vm", "seconds", vmLabels...),
+		vmSnapshotSize:      newDesc("vm_snapshot_size", "Space used by the virtual disks of the snapshots of the vm", "bytes", vmLabels...),
+
+		messages:               newDesc("messages_total", "Number of messages raised by the pool since the exporter started", "", messageLabels...),
+		messagesUnacknowledged: newDesc("messages_unacknowledged", "Messages raised since the exporter started which have not been dismissed yet", "number", messageLabels...),
+
+		rrdHost: newDesc("rrd_host_value", "Latest value of a rrd data source of the xen host", "", "hostname", "data_source", "device"),
+		rrdVM:   newDesc("rrd_vm_value", "Latest value of a rrd data source of a vm", "", "hostname", "vm_uuid", "data_source", "device"),
+
+		rpcCalls: newDesc("rpc_calls", "Number of xen api calls made during the last scrape", "number"),
 	}
-	metric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: *namespace,
-		Name:      "memory_free",
-		Help:      "Total memory of the xen host",
-		ConstLabels: map[string]string{
-			"unit": "bytes",
-		},
-	}, []string{"hostname"})
-
-	labels := prometheus.Labels{"hostname": hostname}
-	metric.With(labels).Set(float64(memTotalInt))
-
-	return metric, err
 }
 
-func (s Xenstats) createHostMemMetrics() (metrics []*prometheus.GaugeVec, err error) {
-	hosts, err := s.xenclient.GetHosts()
-	if err != nil {
-		return metrics, fmt.Errorf("XEN Api Error: %v", err)
+// Describe sends all descriptions
+func (d *xenDescs) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		d.memoryTotal, d.memoryFree,
+		d.hostEnabled, d.hostLive, d.hostUptime, d.hostSoftwareInfo, d.hostPendingUpdates, d.hostIsMaster, d.hostMaintenanceMode,
+		d.storageVirtualAllocation, d.storagePhysicalUtilisation, d.storagePhysicalSize,
+		d.storageInfo, d.storagePBDAttached, d.storageMultipathActive, d.storageMultipathTotal, d.storageAllowedOperation,
+		d.poolHAEnabled, d.haHostFailuresToTolerate, d.haAllowOvercommit, d.haOvercommitted, d.wlbEnabled,
+		d.vmsPerHost, d.cpusHostNum, d.cpusHostUtil, d.cpusUsed, d.cpusFree,
+		d.vmPowerState, d.vmMemoryTarget, d.vmMemoryActual, d.vmMemoryStaticMax, d.vmVCPUs, d.vmStartTime, d.vmResidentHost, d.vmOSInfo,
+		d.pifInfo, d.pifCarrier, d.pifSpeed, d.pifDuplex, d.pifMTU, d.pifVLAN, d.pifManagement, d.pifBondSlave, d.vifAttached,
+		d.vdiVirtualSize, d.vdiPhysicalUtilisation, d.vdiSharable, d.vdiReadOnly, d.vdiIsSnapshot, d.vdiVBDs, d.vbdAttached,
+		d.vmSnapshots, d.vmSnapshotOldestAge, d.vmSnapshotSize,
+		d.messages, d.messagesUnacknowledged,
+		d.rrdHost, d.rrdVM,
+		d.rpcCalls,
+	} {
+		ch <- desc
 	}
+}
 
-	for _, elem := range hosts {
-
-		hostname, err := s.xend.GetSpecificValue("host.get_name_label", elem.Ref)
-		if err != nil {
-			return metrics, fmt.Errorf("XEN Api Error: %v", err)
-		}
-		hostmetrics, err := s.xend.GetSpecificValue("host.get_metrics", elem.Ref)
-		if err != nil {
-			return metrics, fmt.Errorf("XEN Api Error: %v", err)
-		}
-		totalMetric, err := s.createHostTotalMemMetric(hostmetrics.(string), hostname.(string))
-		if err != nil {
-			return metrics, fmt.Errorf("XEN Api Error: %v", err)
-		}
-		metrics = append(metrics, totalMetric)
+// gauge sends a gauge of the pool, the pool label is added to the label values
+func (s Xenstats) gauge(ch chan<- prometheus.Metric, desc *prometheus.Desc, value float64, labels ...string) {
+	ch <- s.newGauge(desc, value, labels...)
+}
 
-		freeMetric, err := s.createHostFreeMemMetric(hostmetrics.(string), hostname.(string))
-		if err != nil {
-			return metrics, err
-		}
-		metrics = append(metrics, freeMetric)
-	}
-	return metrics, err
+// newGauge creates a gauge of the pool
+func (s Xenstats) newGauge(desc *prometheus.Desc, value float64, labels ...string) prometheus.Metric {
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, append([]string{s.pool}, labels...)...)
 }
 
-func (s Xenstats) createStorageVirtualAllocationMetrics(storagemetrics string, labelname string, uuid string, defaultStorage bool) (metric *prometheus.GaugeVec, err error) {
+// counter sends a counter of the pool, the pool label is added to the label values
+func (s Xenstats) counter(ch chan<- prometheus.Metric, desc *prometheus.Desc, value float64, labels ...string) {
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, append([]string{s.pool}, labels...)...)
+}
 
-	valloc, err := s.xend.GetSpecificValue("SR.get_virtual_allocation", storagemetrics)
-	if err != nil {
-		return metric, fmt.Errorf("XEN Api Error: %v", err)
+// getAllRecords returns all records of a class. The records are fetched once
+// per scrape and shared by all collectors.
+func (s Xenstats) getAllRecords(class string) (map[string]ApiRecord, error) {
+	if records, ok := s.records[class]; ok {
+		return records, nil
 	}
-	vallocint, err := strconv.ParseInt(valloc.(string), 10, 64)
-	if err != nil {
-		return metric, fmt.Errorf("value conversation error: %v", err)
+	if s.cache != nil {
+		if records, ok := s.cache.Records(class); ok {
+			s.records[class] = records
+			return records, nil
+		}
 	}
 
-	metric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: *namespace,
-		Name:      "storage_virtual_allocation",
-		Help:      "Memory used by virtual instantances",
-		ConstLabels: map[string]string{
-			"unit":            "bytes",
-			"default_storage": strconv.FormatBool(defaultStorage),
-			"uuid":            uuid,
-		},
-	}, []string{"label"})
-
-	labels := prometheus.Labels{"label": labelname}
-	metric.With(labels).Set(float64(vallocint))
-
-	return metric, err
+	atomic.AddInt64(s.calls, 1)
+	records, err := s.xend.GetAllRecords(class)
+	if err != nil {
+		return nil, fmt.Errorf("XEN Api Error: %v", err)
+	}
+	s.records[class] = records
+	return records, nil
 }
 
-func (s Xenstats) createStoragePhysicalUtilisationMetrics(storagemetrics string, labelname string, uuid string, defaultStorage bool) (metric *prometheus.GaugeVec, err error) {
-
-	phyutil, err := s.xend.GetSpecificValue("SR.get_physical_utilisation", storagemetrics)
-	if err != nil {
-		return metric, fmt.Errorf("XEN Api Error: %v", err)
+// forEachHost creates the metrics of the hosts with at most hostConcurrency
+// hosts at a time, it is meant for collectors doing requests per host. The
+// metrics are sent in the order of the host references. A failing host is
+// skipped and counted as object error.
+func (s Xenstats) forEachHost(ch chan<- prometheus.Metric, hosts map[string]ApiRecord, fn func(host ApiRecord) ([]prometheus.Metric, error)) {
+	concurrency := s.hostConcurrency
+	if concurrency < 1 {
+		concurrency = 1
 	}
 
-	phyutilInt, err := strconv.ParseInt(phyutil.(string), 10, 64)
-	if err != nil {
-		return metric, fmt.Errorf("value conversation error: %v", err)
+	refs := sortedRefs(hosts)
+	metrics := make([][]prometheus.Metric, len(refs))
+	errs := make([]error, len(refs))
+	workers := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, ref := range refs {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, host ApiRecord) {
+			defer wg.Done()
+			metrics[i], errs[i] = fn(host)
+			<-workers
+		}(i, hosts[ref])
 	}
+	wg.Wait()
 
-	metric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: *namespace,
-		Name:      "storage_physical_utilisation",
-		Help:      "Persistent data physical utilization",
-		ConstLabels: map[string]string{
-			"unit":            "bytes",
-			"default_storage": strconv.FormatBool(defaultStorage),
-			"uuid":            uuid,
-		},
-	}, []string{"label"})
+	for i, ref := range refs {
+		if errs[i] != nil {
+			s.objectError("host", recordString(hosts[ref], "name_label"), errs[i])
+			continue
+		}
+		for _, metric := range metrics[i] {
+			ch <- metric
+		}
+	}
+}
 
-	labels := prometheus.Labels{"label": labelname}
-	metric.With(labels).Set(float64(phyutilInt))
+// objectError logs the error of a single object and counts it, the object is
+// skipped while the other objects are still exported
+func (s Xenstats) objectError(class string, name string, err error) {
+	log.Printf("Xen api error in %s %s of pool %s: %v", class, name, s.pool, err)
+	if s.objectErrors != nil {
+		s.objectErrors.WithLabelValues(s.pool, s.collector, class).Inc()
+	}
+}
 
-	return metric, err
+// sortedRefs returns the references of the records in a stable order
+func sortedRefs(records map[string]ApiRecord) []string {
+	refs := make([]string, 0, len(records))
+	for ref := range records {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
 }
 
-func (s Xenstats) createStoragePhysicalSizeMetrics(storagemetrics string, labelname string, uuid string, defaultStorage bool) (metric *prometheus.GaugeVec, err error) {
-	phySize, err := s.xend.GetSpecificValue("SR.get_physical_size", storagemetrics)
+func (s Xenstats) createHostMemMetrics(ch chan<- prometheus.Metric) error {
+	hosts, err := s.getAllRecords("host")
 	if err != nil {
-		return metric, fmt.Errorf("XEN Api Error: %v", err)
+		return err
 	}
-
-	phySizeInt, err := strconv.ParseInt(phySize.(string), 10, 64)
+	allHostMetrics, err := s.getAllRecords("host_metrics")
 	if err != nil {
-		return metric, fmt.Errorf("value conversation error: %v", err)
+		return err
 	}
 
-	metric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: *namespace,
-		Name:      "storage_physical_size",
-		Help:      "Persistent data physical size",
-		ConstLabels: map[string]string{
-			"unit":            "bytes",
-			"default_storage": strconv.FormatBool(defaultStorage),
-			"uuid":            uuid,
-		},
-	}, []string{"label"})
-
-	labels := prometheus.Labels{"label": labelname}
-	metric.With(labels).Set(float64(phySizeInt))
-
-	return metric, err
-}
-
-func (s Xenstats) createMetric(name, help, unit, labelkey string, labelvalue string, value float64) (metric *prometheus.GaugeVec, err error) {
-	metric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: *namespace,
-		Name:      name,
-		Help:      help,
-		ConstLabels: map[string]string{
-			"unit": unit,
-		},
-	}, []string{labelkey})
+	for _, ref := range sortedRefs(hosts) {
+		host := hosts[ref]
+		hostname := recordString(host, "name_label")
+		hostmetrics, ok := allHostMetrics[recordString(host, "metrics")]
+		if !ok {
+			s.objectError("host", hostname, fmt.Errorf("no host metrics"))
+			continue
+		}
 
-	labels := prometheus.Labels{labelkey: labelvalue}
-	metric.With(labels).Set(float64(value))
+		memTotalInt, err := recordInt(hostmetrics, "memory_total")
+		if err != nil {
+			s.objectError("host", hostname, err)
+			continue
+		}
+		memFreeInt, err := recordInt(hostmetrics, "memory_free")
+		if err != nil {
+			s.objectError("host", hostname, err)
+			continue
+		}
 
-	return metric, err
+		s.gauge(ch, s.descs.memoryTotal, float64(memTotalInt), hostname)
+		s.gauge(ch, s.descs.memoryFree, float64(memFreeInt), hostname)
+	}
+	return nil
 }
 
 func Btof(b bool) float64 {
@@ -230,219 +384,307 @@ func Btof(b bool) float64 {
 	return 0
 }
 
-func (s Xenstats) createPoolMetrics() (metrics []*prometheus.GaugeVec, err error) {
-	hosts, err := s.xenclient.GetPools()
+func (s Xenstats) createPoolMetrics(ch chan<- prometheus.Metric) error {
+	pools, err := s.getAllRecords("pool")
 	if err != nil {
-		return metrics, fmt.Errorf("XEN Api Error: %v", err)
+		return err
 	}
 
-	for _, elem := range hosts {
-		nameLabel, err := s.xend.GetSpecificValue("pool.get_name_label", elem.Ref)
-
-		ha_enabled, err := s.xend.GetSpecificValue("pool.get_ha_enabled", elem.Ref)
-		if err != nil {
-			return metrics, fmt.Errorf("XEN Api Error: %v", err)
-		}
-		haEnabledInt := Btof(ha_enabled.(bool))
-		haEnabledMetric, err := s.createMetric("pool_ha_enabled", "true if HA is enabled on the pool, false otherwise", "bool", "pool", nameLabel.(string), float64(haEnabledInt))
-		if err != nil {
-			return metrics, fmt.Errorf("failure during a metric creation: %v", err)
-		}
-		metrics = append(metrics, haEnabledMetric)
+	for _, ref := range sortedRefs(pools) {
+		pool := pools[ref]
+		nameLabel := recordString(pool, "name_label")
 
-		haHostFailuresToTolerate, err := s.xend.GetSpecificValue("pool.get_ha_host_failures_to_tolerate", elem.Ref)
-		if err != nil {
-			return metrics, fmt.Errorf("XEN Api Error: %v", err)
-		}
-		haHostFailuresToTolerateInt, err := strconv.ParseInt(haHostFailuresToTolerate.(string), 10, 64)
+		haHostFailuresToTolerateInt, err := recordInt(pool, "ha_host_failures_to_tolerate")
 		if err != nil {
-			return metrics, fmt.Errorf("value conversation error: %v", err)
+			s.objectError("pool", nameLabel, err)
+			continue
 		}
-		haHostFailuresToTolerateMetric, err := s.createMetric("ha_host_failures_to_tolerate", "Number of host failures to tolerate before the Pool is declared to be overcommitted", "int", "pool", nameLabel.(string), float64(haHostFailuresToTolerateInt))
-		if err != nil {
-			return metrics, fmt.Errorf("failure during a metric creation: %v", err)
-		}
-		metrics = append(metrics, haHostFailuresToTolerateMetric)
 
-		haAllowOvercommit, err := s.xend.GetSpecificValue("pool.get_ha_allow_overcommit", elem.Ref)
-		if err != nil {
-			return metrics, fmt.Errorf("XEN Api Error: %v", err)
-		}
-		haAllowOvercommitInt := Btof(haAllowOvercommit.(bool))
-		haAllowOvercommitMetric, err := s.createMetric("ha_allow_overcommit", "If set to false then operations which would cause the Pool to become overcommitted will be blocked.", "bool", "pool", nameLabel.(string), float64(haAllowOvercommitInt))
-		if err != nil {
-			return metrics, fmt.Errorf("failure during a metric creation: %v", err)
-		}
-		metrics = append(metrics, haAllowOvercommitMetric)
-
-		haOvercommitted, err := s.xend.GetSpecificValue("pool.get_ha_overcommitted", elem.Ref)
-		if err != nil {
-			return metrics, fmt.Errorf("XEN Api Error: %v", err)
-		}
-		haOvercommittedInt := Btof(haOvercommitted.(bool))
-		haOvercommittedMetric, err := s.createMetric("ha_overcommitted", "True if the Pool is considered to be overcommitted i.e. if there exist insufficient physical resources to tolerate the configured number of host failures", "bool", "pool", nameLabel.(string), float64(haOvercommittedInt))
-		if err != nil {
-			return metrics, fmt.Errorf("failure during a metric creation: %v", err)
-		}
-		metrics = append(metrics, haOvercommittedMetric)
-
-		wlbEnabled, err := s.xend.GetSpecificValue("pool.get_wlb_enabled", elem.Ref)
-		if err != nil {
-			return metrics, fmt.Errorf("XEN Api Error: %v", err)
-		}
-		wlbEnabledInt := Btof(wlbEnabled.(bool))
-		wlbEnabledIntMetric, err := s.createMetric("wlb_enabled", "true if workload balancing is enabled on the pool, false otherwise", "bool", "pool", nameLabel.(string), float64(wlbEnabledInt))
-		if err != nil {
-			return metrics, fmt.Errorf("failure during a metric creation: %v", err)
-		}
-		metrics = append(metrics, wlbEnabledIntMetric)
+		s.gauge(ch, s.descs.poolHAEnabled, Btof(recordBool(pool, "ha_enabled")), nameLabel)
+		s.gauge(ch, s.descs.haHostFailuresToTolerate, float64(haHostFailuresToTolerateInt), nameLabel)
+		s.gauge(ch, s.descs.haAllowOvercommit, Btof(recordBool(pool, "ha_allow_overcommit")), nameLabel)
+		s.gauge(ch, s.descs.haOvercommitted, Btof(recordBool(pool, "ha_overcommitted")), nameLabel)
+		s.gauge(ch, s.descs.wlbEnabled, Btof(recordBool(pool, "wlb_enabled")), nameLabel)
 	}
-	return metrics, err
+	return nil
 }
 
-func (s Xenstats) createStorageMetrics() (metrics []*prometheus.GaugeVec, err error) {
-	allstorages, err := s.xend.GetMultiValues("SR.get_all")
+func (s Xenstats) createStorageMetrics(ch chan<- prometheus.Metric) error {
+	allstorages, err := s.getAllRecords("SR")
 	if err != nil {
-		return metrics, fmt.Errorf("XEN Api Error: %v", err)
+		return err
 	}
-	defaultStorage, err := s.xenclient.GetDefaultSR()
+	pools, err := s.getAllRecords("pool")
 	if err != nil {
-		return metrics, fmt.Errorf("XEN Api Error: %v", err)
+		return err
+	}
+	pbds, err := s.getAllRecords("PBD")
+	if err != nil {
+		return err
+	}
+	hosts, err := s.getAllRecords("host")
+	if err != nil {
+		return err
+	}
+	defaultStorages := map[string]bool{}
+	for _, pool := range pools {
+		defaultStorages[recordString(pool, "default_SR")] = true
 	}
 
-	for _, elem := range allstorages {
-
-		storagelabel, err := s.xend.GetSpecificValue("SR.get_name_label", elem.Ref)
-		if err != nil {
-			return metrics, fmt.Errorf("XEN Api Error: %v", err)
+	for _, ref := range sortedRefs(allstorages) {
+		storage := allstorages[ref]
+		labels := []string{
+			recordString(storage, "name_label"),
+			recordString(storage, "uuid"),
+			strconv.FormatBool(defaultStorages[ref]),
 		}
+		s.createStorageHealthMetrics(ch, storage, pbds, hosts)
 
-		storeageuuid, err := s.xend.GetSpecificValue("SR.get_uuid", elem.Ref)
+		vallocint, err := recordInt(storage, "virtual_allocation")
 		if err != nil {
-			return metrics, fmt.Errorf("XEN Api Error: %v", err)
+			s.objectError("SR", labels[0], err)
+			continue
 		}
-
-		var defaultSt = false
-		if defaultStorage.Ref == elem.Ref {
-			defaultSt = true
-		}
-
-		valloc, err := s.createStorageVirtualAllocationMetrics(elem.Ref, storagelabel.(string), storeageuuid.(string), defaultSt)
+		phyutilInt, err := recordInt(storage, "physical_utilisation")
 		if err != nil {
-			return metrics, err
+			s.objectError("SR", labels[0], err)
+			continue
 		}
-
-		metrics = append(metrics, valloc)
-
-		physicalutil, err := s.createStoragePhysicalUtilisationMetrics(elem.Ref, storagelabel.(string), storeageuuid.(string), defaultSt)
+		phySizeInt, err := recordInt(storage, "physical_size")
 		if err != nil {
-			return metrics, err
+			s.objectError("SR", labels[0], err)
+			continue
 		}
-		metrics = append(metrics, physicalutil)
 
-		physicalsize, err := s.createStoragePhysicalSizeMetrics(elem.Ref, storagelabel.(string), storeageuuid.(string), defaultSt)
-		if err != nil {
-			return metrics, err
-		}
-		metrics = append(metrics, physicalsize)
+		s.gauge(ch, s.descs.storageVirtualAllocation, float64(vallocint), labels...)
+		s.gauge(ch, s.descs.storagePhysicalUtilisation, float64(phyutilInt), labels...)
+		s.gauge(ch, s.descs.storagePhysicalSize, float64(phySizeInt), labels...)
 	}
 
-	return metrics, err
+	return nil
 }
 
-func (s Xenstats) createCPUMetric(name, help, unit, hostname string, value float64) (metric *prometheus.GaugeVec, err error) {
-	metric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: *namespace,
-		Name:      name,
-		Help:      help,
-		ConstLabels: map[string]string{
-			"unit": unit,
-		},
-	}, []string{"hostname"})
-
-	labels := prometheus.Labels{"hostname": hostname}
-	metric.With(labels).Set(float64(value))
+func (s Xenstats) createHostCPUMetrics(ch chan<- prometheus.Metric) error {
 
-	return metric, err
-}
-
-func (s Xenstats) createHostCPUMetrics() (metrics []*prometheus.GaugeVec, err error) {
-
-	hosts, err := s.xenclient.GetHosts()
+	hosts, err := s.getAllRecords("host")
+	if err != nil {
+		return err
+	}
+	vms, err := s.getAllRecords("VM")
+	if err != nil {
+		return err
+	}
+	allVMMetrics, err := s.getAllRecords("VM_metrics")
 	if err != nil {
-		log.Printf("service.time call error: %v", err)
+		return err
 	}
-	for _, elem := range hosts {
+
+	for _, ref := range sortedRefs(hosts) {
+		host := hosts[ref]
 		usedCpus := int64(0)
 		vmsPerHost := float64(0)
-		hostname, err := s.xend.GetSpecificValue("host.get_name_label", elem.Ref)
-		if err != nil {
-			return metrics, fmt.Errorf("XEN Api Error: %v", err)
-		}
-		hostcpus, err := s.xend.GetMultiValues("host.get_host_CPUs", elem.Ref)
-		if err != nil {
-			return metrics, fmt.Errorf("XEN Api Error: %v", err)
-		}
-		vms, err := s.xend.GetMultiValues("host.get_resident_VMs", elem.Ref)
-		if err != nil {
-			return metrics, fmt.Errorf("XEN Api Error: %v", err)
-		}
-		for _, elem2 := range vms {
-
-			vmIsControllDomain, err := s.xend.GetSpecificValue("VM.get_is_control_domain", elem2.Ref)
-			if err != nil {
-				return metrics, fmt.Errorf("XEN Api Error: %v", err)
+		hostname := recordString(host, "name_label")
+		hostcpus := recordRefs(host, "host_CPUs")
+
+		for _, vmRef := range recordRefs(host, "resident_VMs") {
+			vm, ok := vms[vmRef]
+			if !ok {
+				// the vm has been destroyed in between the calls
+				continue
 			}
 
-			if vmIsControllDomain.(bool) == false {
-				vmmetrics, err := s.xend.GetSpecificValue("VM.get_metrics", elem2.Ref)
-				if err != nil {
-					return metrics, fmt.Errorf("XEN Api Error: %v", err)
-				}
+			if recordBool(vm, "is_control_domain") == false {
+				vmsPerHost++
 
-				vmCPUCount, err := s.xend.GetSpecificValue("VM_metrics.get_VCPUs_number", vmmetrics.(string))
-				if err != nil {
-					return metrics, fmt.Errorf("XEN Api Error: %v", err)
+				// a vm without metrics, e.g. one still booting, only misses
+				// in the used cpus
+				vmmetrics, ok := allVMMetrics[recordString(vm, "metrics")]
+				if !ok {
+					s.objectError("VM", recordString(vm, "name_label"), fmt.Errorf("no vm metrics"))
+					continue
 				}
-				vmCPUCountint, err := strconv.ParseInt(vmCPUCount.(string), 10, 64)
+
+				vmCPUCountint, err := recordInt(vmmetrics, "VCPUs_number")
 				if err != nil {
-					return metrics, fmt.Errorf("value conversation error: %v", err)
+					s.objectError("VM", recordString(vm, "name_label"), err)
+					continue
 				}
 
 				usedCpus += vmCPUCountint
-				vmsPerHost++
 			}
 		}
 
-		vmsPerHostMetric, err := s.createCPUMetric("vms_per_host", "Number of vm´s on the xenhost", "number", hostname.(string), vmsPerHost)
-		if err != nil {
-			return metrics, fmt.Errorf("failure during a metric creation: %v", err)
-		}
-		metrics = append(metrics, vmsPerHostMetric)
+		s.gauge(ch, s.descs.vmsPerHost, vmsPerHost, hostname)
 
+		// the vms are still counted on a host without cpus
+		if len(hostcpus) == 0 {
+			s.objectError("host", hostname, fmt.Errorf("no cpus found"))
+			continue
+		}
 		cpusFree := int64(len(hostcpus)) - usedCpus
 		cpuUtilPercent := 100 * usedCpus / int64(len(hostcpus))
-		cpuNumMetric, err := s.createCPUMetric("cpus_host_num", "Number of cpu cores on the xenhost", "bytes", hostname.(string), float64(len(hostcpus)))
-		if err != nil {
-			return metrics, fmt.Errorf("failure during a metric creation: %v", err)
+		s.gauge(ch, s.descs.cpusHostNum, float64(len(hostcpus)), hostname)
+		s.gauge(ch, s.descs.cpusHostUtil, float64(cpuUtilPercent), hostname)
+		s.gauge(ch, s.descs.cpusUsed, float64(usedCpus), hostname)
+		s.gauge(ch, s.descs.cpusFree, float64(cpusFree), hostname)
+	}
+	return nil
+}
+
+// vmPowerStates are the power states a vm can be in
+var vmPowerStates = []string{"Halted", "Paused", "Running", "Suspended"}
+
+func recordString(record ApiRecord, key string) string {
+	value, _ := record[key].(string)
+	return value
+}
+
+func recordInt(record ApiRecord, key string) (int64, error) {
+	value, err := strconv.ParseInt(recordString(record, key), 10, 64)
+	if err != nil {
+		return value, fmt.Errorf("value conversation error of %s: %v", key, err)
+	}
+	return value, nil
+}
+
+func recordBool(record ApiRecord, key string) bool {
+	value, _ := record[key].(bool)
+	return value
+}
+
+// recordRefs returns a list of object references, e.g. the resident_VMs of a host
+func recordRefs(record ApiRecord, key string) (refs []string) {
+	values, _ := record[key].([]interface{})
+	for _, value := range values {
+		if ref, ok := value.(string); ok {
+			refs = append(refs, ref)
 		}
-		metrics = append(metrics, cpuNumMetric)
-		cpuUtilPercentageMetric, err := s.createCPUMetric("cpus_host_util", "Used cpu cores on the xenhost in percentage", "percentage", hostname.(string), float64(cpuUtilPercent))
+	}
+	return refs
+}
+
+// recordMap returns a map field like other_config, empty if it is not set
+func recordMap(record ApiRecord, key string) ApiRecord {
+	value, err := toRecord(record[key])
+	if err != nil {
+		return ApiRecord{}
+	}
+	return value
+}
+
+// recordTime returns a xen api datetime, the zero time is returned for unset dates
+func recordTime(record ApiRecord, key string) (time.Time, error) {
+	switch value := record[key].(type) {
+	case time.Time:
+		return value, nil
+	case string:
+		t, err := time.Parse("20060102T15:04:05Z", value)
 		if err != nil {
-			return metrics, fmt.Errorf("failure during a metric creation: %v", err)
+			return t, fmt.Errorf("value conversation error of %s: %v", key, err)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("value conversation error of %s: unexpected type %T", key, record[key])
+}
+
+func (s Xenstats) createVMMetrics(ch chan<- prometheus.Metric) error {
+	vms, err := s.getAllRecords("VM")
+	if err != nil {
+		return err
+	}
+	allVMMetrics, err := s.getAllRecords("VM_metrics")
+	if err != nil {
+		return err
+	}
+	allGuestMetrics, err := s.getAllRecords("VM_guest_metrics")
+	if err != nil {
+		return err
+	}
+	hosts, err := s.getAllRecords("host")
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range sortedRefs(vms) {
+		vm := vms[ref]
+		if recordBool(vm, "is_control_domain") || recordBool(vm, "is_a_template") || recordBool(vm, "is_a_snapshot") {
+			continue
 		}
-		metrics = append(metrics, cpuUtilPercentageMetric)
-		cpusUsedMetric, err := s.createCPUMetric("cpus_used", "Used cpu cores on the xenhost", "number", hostname.(string), float64(usedCpus))
+
+		metrics, err := s.vmMetrics(vm, allVMMetrics, allGuestMetrics, hosts)
 		if err != nil {
-			return metrics, fmt.Errorf("failure during a metric creation: %v", err)
+			s.objectError("VM", recordString(vm, "name_label"), err)
+			continue
 		}
-		metrics = append(metrics, cpusUsedMetric)
-		cpusFreeMetric, err := s.createCPUMetric("cpus_free", "Free cpu cores on the xenhost", "number", hostname.(string), float64(cpusFree))
+		for _, metric := range metrics {
+			ch <- metric
+		}
+	}
+	return nil
+}
+
+// vmMetrics creates the metrics of a single vm
+func (s Xenstats) vmMetrics(vm ApiRecord, allVMMetrics, allGuestMetrics, hosts map[string]ApiRecord) ([]prometheus.Metric, error) {
+	vmName := recordString(vm, "name_label")
+	vmUUID := recordString(vm, "uuid")
+	powerState := recordString(vm, "power_state")
+
+	vmmetrics, ok := allVMMetrics[recordString(vm, "metrics")]
+	if !ok {
+		return nil, fmt.Errorf("no vm metrics")
+	}
+
+	memoryTarget, err := recordInt(vm, "memory_target")
+	if err != nil {
+		return nil, err
+	}
+	memoryStaticMax, err := recordInt(vm, "memory_static_max")
+	if err != nil {
+		return nil, err
+	}
+	memoryActual, err := recordInt(vmmetrics, "memory_actual")
+	if err != nil {
+		return nil, err
+	}
+	vcpus, err := recordInt(vmmetrics, "VCPUs_number")
+	if err != nil {
+		return nil, err
+	}
+	if powerState == "Halted" {
+		vcpus, err = recordInt(vm, "VCPUs_at_startup")
 		if err != nil {
-			return metrics, fmt.Errorf("failure during a metric creation: %v", err)
+			return nil, err
 		}
-		metrics = append(metrics, cpusFreeMetric)
+	}
+	startTime, err := recordTime(vmmetrics, "start_time")
+	if err != nil {
+		return nil, err
+	}
 
+	metrics := []prometheus.Metric{}
+	for _, state := range vmPowerStates {
+		metrics = append(metrics, s.newGauge(s.descs.vmPowerState, Btof(state == powerState), vmName, vmUUID, state))
 	}
-	return metrics, err
+	metrics = append(metrics,
+		s.newGauge(s.descs.vmMemoryTarget, float64(memoryTarget), vmName, vmUUID),
+		s.newGauge(s.descs.vmMemoryStaticMax, float64(memoryStaticMax), vmName, vmUUID),
+		s.newGauge(s.descs.vmMemoryActual, float64(memoryActual), vmName, vmUUID),
+		s.newGauge(s.descs.vmVCPUs, float64(vcpus), vmName, vmUUID),
+		s.newGauge(s.descs.vmStartTime, float64(startTime.Unix()), vmName, vmUUID),
+	)
+
+	if host, ok := hosts[recordString(vm, "resident_on")]; ok {
+		metrics = append(metrics, s.newGauge(s.descs.vmResidentHost, 1, vmName, vmUUID, recordString(host, "name_label")))
+	}
+
+	if guestMetrics, ok := allGuestMetrics[recordString(vm, "guest_metrics")]; ok {
+		osRecord := recordMap(guestMetrics, "os_version")
+		metrics = append(metrics, s.newGauge(s.descs.vmOSInfo, 1, vmName, vmUUID, recordString(osRecord, "name"), recordString(osRecord, "distro"), recordString(osRecord, "major"), recordString(osRecord, "minor")))
+	}
+	return metrics, nil
+}
+
+// createRPCCallsMetric exposes the number of rpc calls made during the scrape
+func (s Xenstats) createRPCCallsMetric(ch chan<- prometheus.Metric) {
+	s.gauge(ch, s.descs.rpcCalls, float64(atomic.LoadInt64(s.calls)))
 }